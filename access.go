@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	contextKeyAccessGranted contextKey = "accessGranted"
+	contextKeyUser          contextKey = "user"
+)
+
+// accessGranted returns true if the client has already been granted access
+// to the site by IP address, in which case authentication can be skipped.
+func accessGranted(ctx context.Context) bool {
+	granted, _ := ctx.Value(contextKeyAccessGranted).(bool)
+	return granted
+}
+
+// authenticatedUser returns the identity of the user, once verified by an
+// authentication directive.
+func authenticatedUser(ctx context.Context) string {
+	user, _ := ctx.Value(contextKeyUser).(string)
+	return user
+}
+
+func withAuthenticatedUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKeyUser, user))
+}
+
+type accessRule struct {
+	allow  bool
+	all    bool
+	prefix netip.Prefix
+}
+
+func (rule *accessRule) match(ip netip.Addr) bool {
+	return rule.all || (ip.IsValid() && rule.prefix.Contains(ip))
+}
+
+// accessControl restricts access to a site by client IP address.
+type accessControl struct {
+	rules []accessRule
+	// If satisfyAny is set, clients allowed by IP address don't need to
+	// authenticate, and other clients may still authenticate
+	satisfyAny bool
+	// Whether the site has an authentication directive
+	auth bool
+}
+
+func parseAccessRules(allow bool, params []string) ([]accessRule, error) {
+	if len(params) == 0 {
+		return nil, fmt.Errorf("expected at least one parameter")
+	}
+
+	var rules []accessRule
+	for _, param := range params {
+		rule := accessRule{allow: allow}
+		switch {
+		case param == "all":
+			rule.all = true
+		case strings.Contains(param, "/"):
+			prefix, err := netip.ParsePrefix(param)
+			if err != nil {
+				return nil, err
+			}
+			rule.prefix = prefix.Masked()
+		default:
+			addr, err := netip.ParseAddr(param)
+			if err != nil {
+				return nil, err
+			}
+			rule.prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// allowed checks whether an IP address is allowed by the rules. The first
+// matching rule wins. If no rule matches, the opposite of the last rule
+// applies.
+func (ac *accessControl) allowed(ip netip.Addr) bool {
+	for _, rule := range ac.rules {
+		if rule.match(ip) {
+			return rule.allow
+		}
+	}
+	return !ac.rules[len(ac.rules)-1].allow
+}
+
+func (ac *accessControl) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ac.allowed(remoteIP(r)) {
+			if ac.satisfyAny {
+				ctx := context.WithValue(r.Context(), contextKeyAccessGranted, true)
+				r = r.WithContext(ctx)
+			}
+		} else if !ac.satisfyAny || !ac.auth {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+const (
+	authRequestTimeout = 10 * time.Second
+	// authRequestDrainLimit is the maximum number of bytes read from the body
+	// of a successful subrequest response, to allow the connection to be
+	// reused.
+	authRequestDrainLimit = 4 << 10
+)
+
+// hopByHopHeaders lists header fields which must not be forwarded, see
+// RFC 9110 section 7.6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// authRequest delegates access control to an external service: each
+// incoming request triggers a subrequest to the service, which decides
+// whether the request is allowed.
+type authRequest struct {
+	target      *url.URL
+	copyHeaders []string
+	client      *http.Client
+}
+
+func parseAuthRequest(dir *scfg.Directive) (*authRequest, error) {
+	var urlStr string
+	if err := dir.ParseParams(&urlStr); err != nil {
+		return nil, err
+	}
+	target, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URI scheme %q", target.Scheme)
+	}
+
+	ar := &authRequest{
+		target: target,
+		client: &http.Client{
+			Timeout: authRequestTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "copy_headers":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			for _, name := range child.Params {
+				ar.copyHeaders = append(ar.copyHeaders, textproto.CanonicalMIMEHeaderKey(name))
+			}
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+
+	return ar, nil
+}
+
+func (ar *authRequest) newSubrequest(r *http.Request) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, ar.target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = r.Header.Clone()
+	for _, k := range hopByHopHeaders {
+		req.Header.Del(k)
+	}
+	req.Header.Del("Content-Length")
+
+	proto := "http"
+	if contextTLSState(r.Context()) != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Uri", r.RequestURI)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	if ip := remoteIP(r); ip.IsValid() {
+		req.Header.Set("X-Forwarded-For", ip.String())
+	} else {
+		req.Header.Del("X-Forwarded-For")
+	}
+
+	return req, nil
+}
+
+func (ar *authRequest) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accessGranted(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		req, err := ar.newSubrequest(r)
+		if err != nil {
+			log.Printf("auth_request: failed to create subrequest: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		resp, err := ar.client.Do(req)
+		if err != nil {
+			log.Printf("auth_request: subrequest failed: %v", err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			// Release the connection before handling the request, so that
+			// it can be reused
+			io.CopyN(io.Discard, resp.Body, authRequestDrainLimit)
+			resp.Body.Close()
+
+			// The incoming request's header is not trusted
+			for _, k := range ar.copyHeaders {
+				r.Header.Del(k)
+				for _, v := range resp.Header.Values(k) {
+					r.Header.Add(k, v)
+				}
+			}
+			next.ServeHTTP(w, r)
+		case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden,
+			resp.StatusCode >= 300 && resp.StatusCode < 400:
+			for k, values := range resp.Header {
+				w.Header()[k] = values
+			}
+			for _, k := range hopByHopHeaders {
+				w.Header().Del(k)
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+		default:
+			log.Printf("auth_request: unexpected subrequest status: %v", resp.Status)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		}
+	})
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdCheckInterval is the minimum delay between two checks for changes
+// of an htpasswd file.
+const htpasswdCheckInterval = time.Second
+
+type basicAuth struct {
+	realm     string
+	users     map[string]string // username → password or password hash
+	htpasswds []*htpasswdFile
+	dummyHash string // password hash of one of the users, if any
+}
+
+func parseBasicAuth(dir *scfg.Directive) (*basicAuth, error) {
+	ba := &basicAuth{users: make(map[string]string)}
+
+	switch len(dir.Params) {
+	case 0:
+		if len(dir.Children) == 0 {
+			return nil, fmt.Errorf("expected either parameters or a block")
+		}
+	case 2:
+		ba.users[dir.Params[0]] = dir.Params[1]
+	default:
+		return nil, fmt.Errorf("expected exactly two parameters")
+	}
+
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "realm":
+			if err := child.ParseParams(&ba.realm); err != nil {
+				return nil, err
+			}
+			if strings.ContainsAny(ba.realm, "\"\\") {
+				return nil, fmt.Errorf("invalid realm %q", ba.realm)
+			}
+		case "user":
+			var username, password string
+			if err := child.ParseParams(&username, &password); err != nil {
+				return nil, err
+			}
+			if _, ok := ba.users[username]; ok {
+				return nil, fmt.Errorf("duplicate user %q", username)
+			}
+			if isPasswordHash(password) {
+				if err := validatePasswordHash(password); err != nil {
+					return nil, fmt.Errorf("user %q: %v", username, err)
+				}
+			}
+			ba.users[username] = password
+		case "htpasswd":
+			var filename string
+			if err := child.ParseParams(&filename); err != nil {
+				return nil, err
+			}
+			f := &htpasswdFile{filename: filename}
+			if err := f.load(); err != nil {
+				return nil, err
+			}
+			ba.htpasswds = append(ba.htpasswds, f)
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+
+	for _, hash := range ba.users {
+		if isPasswordHash(hash) {
+			ba.dummyHash = hash
+			break
+		}
+	}
+
+	return ba, nil
+}
+
+func (ba *basicAuth) lookup(username string) (string, bool) {
+	if hash, ok := ba.users[username]; ok {
+		return hash, true
+	}
+	for _, f := range ba.htpasswds {
+		if hash, ok := f.lookup(username); ok {
+			return hash, true
+		}
+	}
+	return "", false
+}
+
+func (ba *basicAuth) check(username, password string) bool {
+	hash, known := ba.lookup(username)
+	if !known {
+		// Don't reveal which users exist via the response time: check the
+		// password against another user's hash
+		hash = ba.dummyHash
+		for _, f := range ba.htpasswds {
+			if hash != "" {
+				break
+			}
+			hash = f.dummyHash()
+		}
+	}
+
+	if !isPasswordHash(hash) {
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1 && known
+	}
+
+	ok, err := checkPasswordHash(hash, password)
+	if err != nil {
+		log.Printf("basic_auth: failed to check password for user %q: %v", username, err)
+		return false
+	}
+	return ok && known
+}
+
+func (ba *basicAuth) middleware(next http.Handler) http.Handler {
+	challenge := "Basic"
+	if ba.realm != "" {
+		challenge = fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, ba.realm)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accessGranted(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u, p, ok := r.BasicAuth()
+		if !ok || !ba.check(u, p) {
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, withAuthenticatedUser(r, "basic:"+u))
+	})
+}
+
+func isPasswordHash(s string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2i$", "$argon2id$", "$5$", "$6$", "$apr1$", "$1$"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePasswordHash checks that a password hash is well-formed, without
+// going through the expensive hashing process.
+func validatePasswordHash(hash string) error {
+	var err error
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		_, err = bcrypt.Cost([]byte(hash))
+	case strings.HasPrefix(hash, "$argon2"):
+		_, err = parseArgon2(hash)
+	case strings.HasPrefix(hash, "$5$"), strings.HasPrefix(hash, "$6$"):
+		_, err = parseSHACrypt(hash)
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		_, _, err = parseMD5Crypt(hash)
+	default:
+		err = fmt.Errorf("unsupported password hash")
+	}
+	return err
+}
+
+// checkPasswordHash verifies a password against a bcrypt, Argon2, SHA-crypt
+// or MD5-crypt hash.
+func checkPasswordHash(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2"):
+		return checkArgon2(hash, password)
+	case strings.HasPrefix(hash, "$5$"), strings.HasPrefix(hash, "$6$"):
+		return checkSHACrypt(hash, password)
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		return checkMD5Crypt(hash, password)
+	default:
+		return false, fmt.Errorf("unsupported password hash")
+	}
+}
+
+type argon2Params struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2 parses an Argon2 hash in the PHC string format, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>".
+func parseArgon2(hash string) (*argon2Params, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[0] != "" {
+		return nil, fmt.Errorf("malformed Argon2 hash")
+	}
+
+	params := argon2Params{variant: fields[1]}
+	if params.variant != "argon2id" && params.variant != "argon2i" {
+		return nil, fmt.Errorf("unsupported Argon2 variant %q", params.variant)
+	}
+	if fields[2] != "v=19" {
+		return nil, fmt.Errorf("unsupported Argon2 version %q", fields[2])
+	}
+
+	for _, param := range strings.Split(fields[3], ",") {
+		k, v, _ := strings.Cut(param, "=")
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed Argon2 parameter %q", param)
+		}
+		switch k {
+		case "m":
+			params.memory = uint32(n)
+		case "t":
+			params.time = uint32(n)
+		case "p":
+			if n > 255 {
+				return nil, fmt.Errorf("invalid Argon2 parallelism %v", n)
+			}
+			params.threads = uint8(n)
+		}
+	}
+	if params.memory == 0 || params.time == 0 || params.threads == 0 {
+		return nil, fmt.Errorf("missing Argon2 parameters")
+	}
+
+	var err error
+	params.salt, err = base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("malformed Argon2 salt: %v", err)
+	}
+	params.key, err = base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil {
+		return nil, fmt.Errorf("malformed Argon2 hash: %v", err)
+	}
+
+	return &params, nil
+}
+
+// checkArgon2 verifies a password against an Argon2 hash.
+func checkArgon2(hash, password string) (bool, error) {
+	params, err := parseArgon2(hash)
+	if err != nil {
+		return false, err
+	}
+
+	keyLen := uint32(len(params.key))
+	var key []byte
+	if params.variant == "argon2id" {
+		key = argon2.IDKey([]byte(password), params.salt, params.time, params.memory, params.threads, keyLen)
+	} else {
+		key = argon2.Key([]byte(password), params.salt, params.time, params.memory, params.threads, keyLen)
+	}
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+// htpasswdFile is a list of users loaded from an htpasswd file. The file is
+// reloaded when it changes.
+type htpasswdFile struct {
+	filename string
+
+	mu        sync.Mutex
+	users     map[string]string
+	dummy     string // hash of one of the users
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+func (f *htpasswdFile) load() error {
+	fi, err := os.Stat(f.filename)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(f.filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	var dummy string
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("%v:%v: missing colon", f.filename, lineno)
+		}
+		if !isPasswordHash(hash) {
+			return fmt.Errorf("%v:%v: unsupported password hash for user %q", f.filename, lineno, username)
+		}
+		if err := validatePasswordHash(hash); err != nil {
+			return fmt.Errorf("%v:%v: user %q: %v", f.filename, lineno, username, err)
+		}
+		users[username] = hash
+		if dummy == "" {
+			dummy = hash
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %v: %v", f.filename, err)
+	}
+
+	f.users = users
+	f.dummy = dummy
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+	return nil
+}
+
+func (f *htpasswdFile) lookup(username string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now := time.Now(); now.Sub(f.lastCheck) >= htpasswdCheckInterval {
+		f.lastCheck = now
+		fi, err := os.Stat(f.filename)
+		if err != nil {
+			log.Printf("basic_auth: failed to stat %q: %v", f.filename, err)
+		} else if !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size {
+			if err := f.load(); err != nil {
+				log.Printf("basic_auth: failed to reload htpasswd file: %v", err)
+				// Keep the previous users until the file changes again
+				f.modTime = fi.ModTime()
+				f.size = fi.Size()
+			}
+		}
+	}
+
+	hash, ok := f.users[username]
+	return hash, ok
+}
+
+func (f *htpasswdFile) dummyHash() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dummy
+}
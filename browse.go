@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+var browseTemplate = template.Must(template.ParseFS(staticFS, "static/browse.html"))
+
+// directoryListing renders listings for directories without an index file.
+type directoryListing struct {
+	hideDotfiles bool
+}
+
+func parseBrowse(dir *scfg.Directive) (*directoryListing, error) {
+	if len(dir.Params) > 0 {
+		return nil, fmt.Errorf("unexpected parameters")
+	}
+	dl := &directoryListing{}
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "hide_dotfiles":
+			dl.hideDotfiles = true
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+	return dl, nil
+}
+
+type browseEntry struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// HumanSize formats the size with a binary unit, e.g. "1.5 KiB".
+func (entry *browseEntry) HumanSize() string {
+	const units = "KMGTPE"
+	if entry.Size < 1024 {
+		return fmt.Sprintf("%d B", entry.Size)
+	}
+	size := float64(entry.Size) / 1024
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", size, units[i])
+}
+
+type browseBreadcrumb struct {
+	Name string
+	URL  string
+}
+
+type browseData struct {
+	Path       string
+	Breadcrumb []browseBreadcrumb
+	Entries    []*browseEntry
+	Sort       string
+	Order      string
+}
+
+// NextOrder returns the sort order to use for a column's link: clicking on the
+// current sort column reverses the order.
+func (data *browseData) NextOrder(column string) string {
+	if column == data.Sort && data.Order == "asc" {
+		return "desc"
+	}
+	return "asc"
+}
+
+// serve writes a listing for the requested directory. It returns false if
+// the request doesn't refer to a directory without an index file, in which
+// case nothing is written.
+func (dl *directoryListing) serve(w http.ResponseWriter, r *http.Request, fs http.FileSystem) bool {
+	urlPath := r.URL.Path
+	if !strings.HasPrefix(urlPath, "/") {
+		urlPath = "/" + urlPath
+	}
+	if !strings.HasSuffix(urlPath, "/") {
+		// http.FileServer redirects to the path with a trailing slash
+		return false
+	}
+	name := path.Clean(urlPath)
+
+	f, err := fs.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	if index, err := fs.Open(path.Join(name, "index.html")); err == nil {
+		index.Close()
+		return false
+	}
+
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		log.Printf("failed to read directory %q: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return true
+	}
+
+	entries := make([]*browseEntry, 0, len(infos))
+	for _, info := range infos {
+		if dl.hideDotfiles && strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		entry := &browseEntry{
+			Name:    info.Name(),
+			IsDir:   info.IsDir(),
+			ModTime: info.ModTime().UTC(),
+		}
+		// url.URL takes care of names which look like a URL scheme
+		u := url.URL{Path: info.Name()}
+		entry.URL = u.String()
+		if entry.IsDir {
+			entry.URL += "/"
+		} else {
+			entry.Size = info.Size()
+		}
+		entries = append(entries, entry)
+	}
+
+	data := &browseData{
+		Path:    urlPath,
+		Entries: entries,
+		Sort:    r.URL.Query().Get("sort"),
+		Order:   r.URL.Query().Get("order"),
+	}
+	if data.Sort == "" {
+		data.Sort = "name"
+	}
+	if data.Order != "desc" {
+		data.Order = "asc"
+	}
+	sortBrowseEntries(entries, data.Sort, data.Order == "desc")
+
+	// Links are relative, so that they work regardless of the site's path
+	var elems []string
+	if name != "/" {
+		elems = strings.Split(strings.TrimPrefix(name, "/"), "/")
+	}
+	data.Breadcrumb = append(data.Breadcrumb, browseBreadcrumb{Name: "/", URL: relativeParent(len(elems))})
+	for i, elem := range elems {
+		data.Breadcrumb = append(data.Breadcrumb, browseBreadcrumb{
+			Name: elem + "/",
+			URL:  relativeParent(len(elems) - i - 1),
+		})
+	}
+
+	h := w.Header()
+	addVary(h, "Accept")
+	if acceptsJSON(r.Header.Get("Accept")) {
+		h.Set("Content-Type", "application/json")
+		if r.Method == http.MethodHead {
+			return true
+		}
+		if err := json.NewEncoder(w).Encode(entries); err != nil {
+			log.Printf("failed to write directory listing: %v", err)
+		}
+		return true
+	}
+
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return true
+	}
+	if err := browseTemplate.Execute(w, data); err != nil {
+		log.Printf("failed to render directory listing: %v", err)
+	}
+	return true
+}
+
+func sortBrowseEntries(entries []*browseEntry, by string, desc bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.IsDir != b.IsDir {
+			// Directories always come first
+			return a.IsDir
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch by {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "time":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+		return a.Name < b.Name
+	})
+}
+
+// relativeParent returns a relative URL referring to the n-th parent
+// directory.
+func relativeParent(n int) string {
+	if n == 0 {
+		return "./"
+	}
+	return strings.Repeat("../", n)
+}
+
+// acceptsJSON checks whether an Accept header field prefers JSON over HTML.
+func acceptsJSON(accept string) bool {
+	for _, elem := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(elem, ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,849 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+const (
+	cacheDefaultMaxSize       = 64 << 20
+	cacheDefaultMaxObjectSize = 1 << 20
+
+	// cacheHeuristicMaxAge caps heuristic freshness lifetimes (RFC 9111
+	// section 4.2.2).
+	cacheHeuristicMaxAge = 24 * time.Hour
+)
+
+// cacheHeuristicStatus lists the status codes which are heuristically
+// cacheable (RFC 9110 section 15.1). 206 is omitted since partial responses
+// aren't stored.
+var cacheHeuristicStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// httpCache is a shared cache as defined in RFC 9111.
+type httpCache struct {
+	maxObjectSize        int64
+	paths                []string
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	// Whether requests are authenticated by a directive listed after cache,
+	// e.g. with a cookie or a client certificate
+	auth bool
+
+	state atomic.Pointer[cacheState]
+}
+
+type cacheState struct {
+	store cacheStore
+
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+func parseCache(dir *scfg.Directive) (*httpCache, error) {
+	c := &httpCache{maxObjectSize: cacheDefaultMaxObjectSize}
+	maxSize := int64(cacheDefaultMaxSize)
+	var storeDir string
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "store":
+			var kind string
+			if err := child.ParseParams(&kind); err != nil {
+				return nil, err
+			}
+			switch kind {
+			case "memory":
+				storeDir = ""
+			case "disk":
+				if err := child.ParseParams(nil, &storeDir); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("directive %q: unknown store %q", child.Name, kind)
+			}
+		case "max_size", "max_object_size":
+			var sizeStr string
+			if err := child.ParseParams(&sizeStr); err != nil {
+				return nil, err
+			}
+			size, err := parseSize(sizeStr)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			} else if size <= 0 {
+				return nil, fmt.Errorf("directive %q: size must be positive", child.Name)
+			}
+			if child.Name == "max_size" {
+				maxSize = size
+			} else {
+				c.maxObjectSize = size
+			}
+		case "path":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			c.paths = append(c.paths, child.Params...)
+		case "stale_while_revalidate", "stale_if_error":
+			var durationStr string
+			if err := child.ParseParams(&durationStr); err != nil {
+				return nil, err
+			}
+			d, err := time.ParseDuration(durationStr)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			} else if d <= 0 {
+				return nil, fmt.Errorf("directive %q: duration must be positive", child.Name)
+			}
+			if child.Name == "stale_while_revalidate" {
+				c.staleWhileRevalidate = d
+			} else {
+				c.staleIfError = d
+			}
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+
+	var store cacheStore
+	if storeDir != "" {
+		var err error
+		if store, err = newDiskCacheStore(storeDir, maxSize); err != nil {
+			return nil, err
+		}
+	} else {
+		store = newMemoryCacheStore(maxSize)
+	}
+
+	c.state.Store(&cacheState{
+		store:    store,
+		inflight: make(map[string]chan struct{}),
+	})
+	return c, nil
+}
+
+// takeOver makes the cache share the stored responses of an older one.
+func (c *httpCache) takeOver(old *httpCache) {
+	c.state.Store(old.state.Load())
+}
+
+// begin marks a request for the specified key as in progress. If another
+// request is already in progress, it returns false and a channel closed when
+// that request is done.
+func (st *cacheState) begin(key string) (bool, <-chan struct{}) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if ch, ok := st.inflight[key]; ok {
+		return false, ch
+	}
+	st.inflight[key] = make(chan struct{})
+	return true, nil
+}
+
+func (st *cacheState) end(key string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	close(st.inflight[key])
+	delete(st.inflight, key)
+}
+
+// lookup returns the stored response for a request, and the key under which
+// it's stored.
+func (st *cacheState) lookup(key string, r *http.Request) (*cacheEntry, string) {
+	e := st.store.get(key)
+	if e == nil || e.Vary == nil {
+		return e, key
+	}
+	key = cacheVariantKey(e, r)
+	return st.store.get(key), key
+}
+
+// put stores a response. key is the primary key, i.e. without variant.
+func (st *cacheState) put(key string, r *http.Request, e *cacheEntry) {
+	vary := parseVary(e.Header)
+	if len(vary) == 0 {
+		e.Key = key
+		st.store.put(e)
+		return
+	}
+
+	variants := st.store.get(key)
+	if variants == nil || variants.Vary == nil || !slices.Equal(variants.Vary, vary) {
+		variants = &cacheEntry{
+			Key:    key,
+			Vary:   vary,
+			VaryID: newCacheVaryID(),
+		}
+		st.store.put(variants)
+	}
+	e.Key = cacheVariantKey(variants, r)
+	st.store.put(e)
+}
+
+func cacheKey(r *http.Request) string {
+	scheme := "http"
+	if contextTLSState(r.Context()) != nil {
+		scheme = "https"
+	}
+	return cacheKeyForURI(scheme, r.Host, r.RequestURI)
+}
+
+func cacheKeyForURI(scheme, host, requestURI string) string {
+	return scheme + "://" + host + requestURI
+}
+
+func cacheVariantKey(variants *cacheEntry, r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(variants.Key)
+	sb.WriteString("\n" + variants.VaryID + "\n")
+	for _, name := range variants.Vary {
+		sb.WriteString(name + ":")
+		for _, v := range r.Header.Values(name) {
+			sb.WriteString(" " + strings.TrimSpace(v))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func newCacheVaryID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// parseVary returns the header field names listed in the Vary header field.
+func parseVary(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// cacheControl holds the directives of a Cache-Control header field.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range h.Values("Cache-Control") {
+		for v != "" {
+			var item string
+			item, v = cutCacheControlItem(v)
+			name, value, _ := strings.Cut(item, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			value = strings.TrimSpace(value)
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+			if name != "" {
+				cc[name] = value
+			}
+		}
+	}
+	if len(h.Values("Cache-Control")) == 0 && strings.EqualFold(h.Get("Pragma"), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+// cutCacheControlItem splits the first item of a Cache-Control list, taking
+// quoted strings into account.
+func cutCacheControlItem(s string) (item, rest string) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			if quoted {
+				i++
+			}
+		case ',':
+			if !quoted {
+				return s[:i], s[i+1:]
+			}
+		}
+	}
+	return s, ""
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the value of a directive holding a number of seconds.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		// Invalid values are treated as zero (RFC 9111 section 1.2.2)
+		return 0, true
+	}
+	if n > int64(cacheMaxSeconds) {
+		n = int64(cacheMaxSeconds)
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheMaxSeconds is the largest delta-seconds value which doesn't overflow a
+// time.Duration.
+const cacheMaxSeconds = int64(1<<63-1) / int64(time.Second)
+
+// freshnessLifetime computes the freshness lifetime of a stored response (RFC
+// 9111 section 4.2.1).
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if v := e.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return expires.Sub(e.date())
+	}
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && cacheHeuristicStatus[e.Status] {
+		d := e.date().Sub(lastModified) / 10
+		if d > cacheHeuristicMaxAge {
+			d = cacheHeuristicMaxAge
+		}
+		return d
+	}
+	return 0
+}
+
+func (e *cacheEntry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// age computes the current age of a stored response (RFC 9111 section
+// 4.2.3).
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := e.ResponseTime.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n >= 0 && n <= cacheMaxSeconds {
+		ageValue = time.Duration(n) * time.Second
+	}
+	correctedAgeValue := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	correctedInitialAge := apparentAge
+	if correctedAgeValue > correctedInitialAge {
+		correctedInitialAge = correctedAgeValue
+	}
+	return correctedInitialAge + now.Sub(e.ResponseTime)
+}
+
+// mayServeStale checks whether a stored response can be served stale (RFC
+// 9111 section 4.2.4).
+func (e *cacheEntry) mayServeStale() bool {
+	cc := parseCacheControl(e.Header)
+	return !cc.has("must-revalidate") && !cc.has("proxy-revalidate") && !cc.has("no-cache") && !cc.has("s-maxage")
+}
+
+// staleWindow returns for how long a stored response can be served stale
+// under the conditions of the specified Cache-Control extension (RFC 5861),
+// with def as the default duration.
+func (e *cacheEntry) staleWindow(directive string, def time.Duration) time.Duration {
+	if !e.mayServeStale() {
+		return 0
+	}
+	if d, ok := parseCacheControl(e.Header).seconds(directive); ok {
+		return d
+	}
+	return def
+}
+
+// revalidated returns a copy of the entry updated with the header fields of
+// a 304 response (RFC 9111 section 4.3.4).
+func (e *cacheEntry) revalidated(h http.Header, requestTime, responseTime time.Time) *cacheEntry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for k, v := range h {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range":
+			continue
+		}
+		updated.Header[k] = v
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+	return &updated
+}
+
+// storable checks whether a response can be stored (RFC 9111 section 3).
+func (c *httpCache) storable(r *http.Request, status int, h http.Header) bool {
+	if r.Method != http.MethodGet || status == http.StatusPartialContent || status == http.StatusNotModified || status < 200 {
+		return false
+	}
+	if parseCacheControl(r.Header).has("no-store") {
+		return false
+	}
+	cc := parseCacheControl(h)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	// Responses setting cookies are most likely specific to a client
+	if h.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, name := range parseVary(h) {
+		if name == "*" {
+			return false
+		}
+	}
+	// Responses to authenticated requests may be specific to the user
+	authenticated := r.Header.Get("Authorization") != "" || c.auth
+	if authenticated && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+
+	explicit := cc.has("s-maxage") || cc.has("max-age") || h.Get("Expires") != ""
+	if !explicit && !cc.has("public") && !cacheHeuristicStatus[status] {
+		return false
+	}
+	// Responses which can't be reused without revalidation are only useful
+	// if they can be revalidated
+	validators := h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+	return explicit || validators || cacheHeuristicStatus[status] && h.Get("Last-Modified") != ""
+}
+
+// invalidate removes the stored responses for the target URI of an unsafe
+// request, and for the URIs in the Location and Content-Location header
+// fields of its response (RFC 9111 section 4.4).
+func (c *httpCache) invalidate(r *http.Request, h http.Header) {
+	st := c.state.Load()
+	key := cacheKey(r)
+	st.store.remove(key)
+
+	scheme, _, _ := strings.Cut(key, ":")
+	base := &url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path}
+	for _, name := range []string{"Location", "Content-Location"} {
+		v := h.Get(name)
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil {
+			continue
+		}
+		u = base.ResolveReference(u)
+		if u.Host == r.Host && u.Scheme == scheme {
+			st.store.remove(cacheKeyForURI(scheme, r.Host, u.RequestURI()))
+		}
+	}
+}
+
+func (c *httpCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(c.paths) > 0 && !matchPath(c.paths, requestPath(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			// Handled below
+		case http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		default:
+			iw := &interceptRW{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(iw, r)
+			if iw.status >= 200 && iw.status < 400 {
+				c.invalidate(r, w.Header())
+			}
+			return
+		}
+
+		if r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c.serve(w, r, next)
+	})
+}
+
+func (c *httpCache) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	st := c.state.Load()
+	key := cacheKey(r)
+	reqCC := parseCacheControl(r.Header)
+
+	e, variantKey := st.lookup(key, r)
+	if e != nil && c.serveStored(w, r, next, st, key, variantKey, e, reqCC) {
+		return
+	}
+	if reqCC.has("only-if-cached") {
+		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+		return
+	}
+	if r.Method == http.MethodHead {
+		// Only responses to GET requests are stored
+		w.Header().Set("X-Cache", "MISS")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	// Coalesce concurrent requests for the same response
+	leader, wait := st.begin(variantKey)
+	if !leader {
+		select {
+		case <-wait:
+		case <-r.Context().Done():
+			return
+		}
+		e, variantKey = st.lookup(key, r)
+		if e != nil && c.serveStored(w, r, next, st, key, variantKey, e, reqCC) {
+			return
+		}
+		// The response couldn't be stored, send our own request
+		c.fetch(w, r, next, st, key, e, func() {})
+		return
+	}
+	release := sync.OnceFunc(func() {
+		st.end(variantKey)
+	})
+	defer release()
+
+	c.fetch(w, r, next, st, key, e, release)
+}
+
+// serveStored tries to serve a stored response. It returns false if the
+// response needs to be fetched or revalidated.
+func (c *httpCache) serveStored(w http.ResponseWriter, r *http.Request, next http.Handler, st *cacheState, key, variantKey string, e *cacheEntry, reqCC cacheControl) bool {
+	now := time.Now()
+	age := e.age(now)
+	lifetime := e.freshnessLifetime()
+
+	if !reqCC.has("no-cache") {
+		acceptable := true
+		if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+			acceptable = false
+		}
+		if minFresh, ok := reqCC.seconds("min-fresh"); ok && lifetime-age < minFresh {
+			acceptable = false
+		}
+		if acceptable && lifetime > age {
+			c.serveEntry(w, r, e, "HIT")
+			return true
+		}
+	}
+
+	staleness := age - lifetime
+	if staleness <= 0 || reqCC.has("no-cache") {
+		return false
+	}
+	if v, ok := reqCC["max-stale"]; ok && e.mayServeStale() {
+		maxStale, _ := reqCC.seconds("max-stale")
+		if v == "" || staleness <= maxStale {
+			c.serveEntry(w, r, e, "STALE")
+			return true
+		}
+	}
+	if staleness <= e.staleWindow("stale-while-revalidate", c.staleWhileRevalidate) {
+		c.revalidateBackground(r, next, st, key, variantKey, e)
+		c.serveEntry(w, r, e, "STALE")
+		return true
+	}
+	return false
+}
+
+// fetch forwards a request to the next handler and stores the response. If
+// stored is non-nil, the stored response is revalidated. release is called
+// as soon as the response is known not to be stored.
+func (c *httpCache) fetch(w http.ResponseWriter, r *http.Request, next http.Handler, st *cacheState, key string, stored *cacheEntry, release func()) {
+	fr := r
+	conditional := false
+	if stored != nil {
+		fr = r.Clone(r.Context())
+		conditional = setCacheValidators(fr.Header, stored)
+	}
+
+	cw := newCacheRW(w, c.maxObjectSize)
+	cw.release = release
+	cw.storable = func(status int, h http.Header) bool {
+		return c.storable(r, status, h)
+	}
+	if stored != nil {
+		sie := stored.staleWindow("stale-if-error", c.staleIfError)
+		staleness := stored.age(time.Now()) - stored.freshnessLifetime()
+		cw.hold = func(status int) bool {
+			return (conditional && status == http.StatusNotModified) || (status >= 500 && sie > 0 && staleness <= sie)
+		}
+	}
+
+	requestTime := time.Now()
+	next.ServeHTTP(cw, fr)
+	responseTime := time.Now()
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	switch {
+	case cw.held && cw.status == http.StatusNotModified:
+		e := stored.revalidated(cw.snapshot, requestTime, responseTime)
+		st.put(key, r, e)
+		c.serveEntry(w, r, e, "REVALIDATED")
+	case cw.held:
+		c.serveEntry(w, r, stored, "STALE")
+	case !cw.tooLarge && c.storable(r, cw.status, cw.snapshot):
+		st.put(key, r, &cacheEntry{
+			Status:       cw.status,
+			Header:       cw.snapshot,
+			RequestTime:  requestTime,
+			ResponseTime: responseTime,
+			Upstream:     isUpstreamResponse(r.Context()),
+			Body:         cw.body.Bytes(),
+		})
+	}
+}
+
+// revalidateBackground revalidates a stored response in the background,
+// unless a request for it is already in progress.
+func (c *httpCache) revalidateBackground(r *http.Request, next http.Handler, st *cacheState, key, variantKey string, stored *cacheEntry) {
+	if leader, _ := st.begin(variantKey); !leader {
+		return
+	}
+
+	// The request may outlive the client's
+	ctx := context.WithoutCancel(r.Context())
+	ctx = context.WithValue(ctx, contextKeyUpstreamResponse, new(bool))
+	br := r.Clone(ctx)
+	for _, k := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range"} {
+		br.Header.Del(k)
+	}
+	conditional := setCacheValidators(br.Header, stored)
+
+	go func() {
+		defer st.end(variantKey)
+		defer func() {
+			if v := recover(); v != nil && v != http.ErrAbortHandler {
+				log.Printf("panic during cache revalidation: %v", v)
+			}
+		}()
+
+		cw := newCacheRW(&discardRW{header: make(http.Header)}, c.maxObjectSize)
+		cw.hold = func(status int) bool {
+			return (conditional && status == http.StatusNotModified) || status >= 500
+		}
+
+		requestTime := time.Now()
+		next.ServeHTTP(cw, br)
+		responseTime := time.Now()
+		if cw.status == 0 {
+			cw.WriteHeader(http.StatusOK)
+		}
+
+		switch {
+		case cw.held && cw.status == http.StatusNotModified:
+			st.put(key, br, stored.revalidated(cw.snapshot, requestTime, responseTime))
+		case cw.held:
+			// Keep the stale response
+		case !cw.tooLarge && c.storable(br, cw.status, cw.snapshot):
+			st.put(key, br, &cacheEntry{
+				Status:       cw.status,
+				Header:       cw.snapshot,
+				RequestTime:  requestTime,
+				ResponseTime: responseTime,
+				Upstream:     isUpstreamResponse(ctx),
+				Body:         cw.body.Bytes(),
+			})
+		default:
+			st.store.remove(key)
+		}
+	}()
+}
+
+// setCacheValidators replaces the conditional header fields with the ones
+// used to revalidate a stored response. It returns false if the response has
+// no validator.
+func setCacheValidators(h http.Header, stored *cacheEntry) bool {
+	etag := stored.Header.Get("ETag")
+	lastModified := stored.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return false
+	}
+	h.Del("If-None-Match")
+	h.Del("If-Modified-Since")
+	if etag != "" {
+		h.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		h.Set("If-Modified-Since", lastModified)
+	}
+	return true
+}
+
+func (c *httpCache) serveEntry(w http.ResponseWriter, r *http.Request, e *cacheEntry, status string) {
+	h := w.Header()
+	for k, v := range e.Header {
+		// The slices may be modified by other handlers
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set("Age", strconv.FormatInt(int64(e.age(time.Now())/time.Second), 10))
+	h.Set("X-Cache", status)
+	if e.Upstream {
+		markUpstreamResponse(r.Context())
+	}
+
+	if e.Status == http.StatusOK {
+		// Handles conditional and range requests
+		lastModified, _ := http.ParseTime(e.Header.Get("Last-Modified"))
+		http.ServeContent(w, r, "", lastModified, bytes.NewReader(e.Body))
+		return
+	}
+
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// cacheRW forwards a response to the client while recording it. Only the
+// header fields set by the next handlers are recorded. Responses can also be
+// held back, to be replaced with a stored response.
+type cacheRW struct {
+	http.ResponseWriter
+	header   http.Header
+	limit    int64
+	hold     func(status int) bool                // optional
+	storable func(status int, h http.Header) bool // optional
+	release  func()                               // called if the response won't be stored
+
+	status   int
+	snapshot http.Header
+	held     bool
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+var _ http.Flusher = (*cacheRW)(nil)
+
+func newCacheRW(w http.ResponseWriter, limit int64) *cacheRW {
+	return &cacheRW{
+		ResponseWriter: w,
+		header:         make(http.Header),
+		limit:          limit,
+		release:        func() {},
+	}
+}
+
+func (w *cacheRW) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *cacheRW) Header() http.Header {
+	return w.header
+}
+
+func (w *cacheRW) WriteHeader(status int) {
+	if w.status != 0 || status < 200 {
+		// Informational responses aren't forwarded
+		return
+	}
+	w.status = status
+	w.snapshot = w.header.Clone()
+	if w.hold != nil && w.hold(status) {
+		w.held = true
+		return
+	}
+	if w.storable != nil && !w.storable(status, w.snapshot) {
+		w.release()
+	}
+
+	dst := w.ResponseWriter.Header()
+	for k, v := range w.header {
+		dst[k] = v
+	}
+	dst.Set("X-Cache", "MISS")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheRW) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.tooLarge {
+		if int64(w.body.Len()+len(b)) > w.limit {
+			w.tooLarge = true
+			w.body = bytes.Buffer{}
+			w.release()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	if w.held {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheRW) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.held {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+// discardRW is a response writer which discards the response.
+type discardRW struct {
+	header http.Header
+}
+
+func (w *discardRW) Header() http.Header {
+	return w.header
+}
+
+func (w *discardRW) WriteHeader(status int) {}
+
+func (w *discardRW) Write(b []byte) (int, error) {
+	return len(b), nil
+}
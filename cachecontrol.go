@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+// etagCacheSize is the maximum number of entries in an ETag cache.
+const etagCacheSize = 4096
+
+// cacheRule sets caching header fields for files matching a path or a media
+// type.
+type cacheRule struct {
+	paths []string
+	types []string
+
+	cacheControl string
+	expires      time.Duration
+	hasExpires   bool
+}
+
+func parseCacheRule(dir *scfg.Directive) (*cacheRule, error) {
+	rule := &cacheRule{}
+	switch dir.Name {
+	case "cache_control":
+		if err := dir.ParseParams(&rule.cacheControl); err != nil {
+			return nil, err
+		}
+	case "expires":
+		var durationStr string
+		if err := dir.ParseParams(&durationStr); err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(durationStr)
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("invalid duration %q", durationStr)
+		}
+		rule.expires = d
+		rule.hasExpires = true
+	default:
+		panic("unreachable")
+	}
+
+	for _, child := range dir.Children {
+		if len(child.Params) == 0 {
+			return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+		}
+		switch child.Name {
+		case "path":
+			rule.paths = append(rule.paths, child.Params...)
+		case "type":
+			rule.types = append(rule.types, child.Params...)
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+
+	return rule, nil
+}
+
+// match checks whether the rule applies to a file. Patterns without a slash
+// are matched against the file's base name.
+func (rule *cacheRule) match(name, contentType string) bool {
+	if len(rule.paths) == 0 && len(rule.types) == 0 {
+		return true
+	}
+	for _, pattern := range rule.paths {
+		if strings.Contains(pattern, "/") {
+			if matchPath([]string{pattern}, name) {
+				return true
+			}
+		} else if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+	return matchMediaType(rule.types, contentType)
+}
+
+func (rule *cacheRule) apply(h http.Header) {
+	if rule.hasExpires {
+		h.Set("Cache-Control", "max-age="+strconv.Itoa(int(rule.expires.Seconds())))
+		h.Set("Expires", time.Now().Add(rule.expires).UTC().Format(http.TimeFormat))
+	} else {
+		h.Set("Cache-Control", rule.cacheControl)
+	}
+}
+
+type etagCacheKey struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// etagCache computes strong ETags from file contents, and caches them in
+// memory.
+type etagCache struct {
+	mu      sync.Mutex
+	entries map[etagCacheKey]string
+}
+
+func newETagCache() *etagCache {
+	return &etagCache{entries: make(map[etagCacheKey]string)}
+}
+
+func (c *etagCache) get(fs http.FileSystem, name string) (string, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%q is not a regular file", name)
+	}
+	k := etagCacheKey{name, fi.Size(), fi.ModTime()}
+
+	c.mu.Lock()
+	etag, ok := c.entries[k]
+	c.mu.Unlock()
+	if ok {
+		return etag, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	etag = `"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16]) + `"`
+
+	c.mu.Lock()
+	if len(c.entries) >= etagCacheSize {
+		// Entries for outdated files are never removed otherwise
+		c.entries = make(map[etagCacheKey]string)
+	}
+	c.entries[k] = etag
+	c.mu.Unlock()
+
+	return etag, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a stored response. Entries are immutable once stored.
+type cacheEntry struct {
+	Key string `json:"key"`
+
+	// For entries describing the variants of a response with a Vary header
+	// field: the header field names, and an identifier which changes when the
+	// variants are invalidated
+	Vary   []string `json:"vary,omitempty"`
+	VaryID string   `json:"vary_id,omitempty"`
+
+	Status       int         `json:"status,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	RequestTime  time.Time   `json:"request_time"`
+	ResponseTime time.Time   `json:"response_time"`
+	Upstream     bool        `json:"upstream,omitempty"`
+	Body         []byte      `json:"-"`
+}
+
+func (e *cacheEntry) size() int64 {
+	n := len(e.Key) + len(e.Body)
+	for k, values := range e.Header {
+		for _, v := range values {
+			n += len(k) + len(v) + 4
+		}
+	}
+	for _, name := range e.Vary {
+		n += len(name)
+	}
+	return int64(n)
+}
+
+type cacheStore interface {
+	get(key string) *cacheEntry
+	put(e *cacheEntry)
+	remove(key string)
+}
+
+// memoryCacheStore keeps entries in memory, and evicts the least recently
+// used ones when the maximum size is exceeded.
+type memoryCacheStore struct {
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element // values are *cacheEntry
+	lru     list.List                // most recently used first
+}
+
+func newMemoryCacheStore(maxSize int64) *memoryCacheStore {
+	return &memoryCacheStore{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (s *memoryCacheStore) get(key string) *cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry)
+}
+
+func (s *memoryCacheStore) put(e *cacheEntry) {
+	size := e.size()
+	if size > s.maxSize {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeLocked(e.Key)
+	for s.size+size > s.maxSize {
+		s.removeLocked(s.lru.Back().Value.(*cacheEntry).Key)
+	}
+	s.entries[e.Key] = s.lru.PushFront(e)
+	s.size += size
+}
+
+func (s *memoryCacheStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(key)
+}
+
+func (s *memoryCacheStore) removeLocked(key string) {
+	elem, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	s.lru.Remove(elem)
+	delete(s.entries, key)
+	s.size -= elem.Value.(*cacheEntry).size()
+}
+
+// diskCacheStore keeps entries in files named after the hash of their key.
+// Each file contains the JSON-encoded entry on the first line, followed by
+// the body.
+type diskCacheStore struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	size  int64
+	files map[string]*list.Element // values are *diskCacheFile
+	lru   list.List                // most recently used first
+}
+
+type diskCacheFile struct {
+	name string
+	size int64
+}
+
+func newDiskCacheStore(dir string, maxSize int64) (*diskCacheStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type existingFile struct {
+		diskCacheFile
+		modTime time.Time
+	}
+	var existing []existingFile
+	for _, de := range dirEntries {
+		name := de.Name()
+		if strings.HasPrefix(name, ".tmp-") {
+			// Left over by an interrupted write
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !de.Type().IsRegular() || len(name) != sha256.Size*2 {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		existing = append(existing, existingFile{diskCacheFile{name, fi.Size()}, fi.ModTime()})
+	}
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].modTime.Before(existing[j].modTime)
+	})
+
+	s := &diskCacheStore{
+		dir:     dir,
+		maxSize: maxSize,
+		files:   make(map[string]*list.Element),
+	}
+	for _, f := range existing {
+		f := f.diskCacheFile
+		s.files[f.name] = s.lru.PushFront(&f)
+		s.size += f.size
+	}
+	s.mu.Lock()
+	s.evictLocked()
+	s.mu.Unlock()
+	return s, nil
+}
+
+func diskCacheFilename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *diskCacheStore) get(key string) *cacheEntry {
+	name := diskCacheFilename(key)
+
+	s.mu.Lock()
+	elem, ok := s.files[name]
+	if ok {
+		s.lru.MoveToFront(elem)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	b, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("failed to read cache file: %v", err)
+		}
+		s.remove(key)
+		return nil
+	}
+	meta, body, ok := bytes.Cut(b, []byte("\n"))
+	var e cacheEntry
+	if !ok || json.Unmarshal(meta, &e) != nil {
+		log.Printf("invalid cache file %q", name)
+		s.remove(key)
+		return nil
+	} else if e.Key != key {
+		return nil
+	}
+	e.Body = body
+	return &e
+}
+
+func (s *diskCacheStore) put(e *cacheEntry) {
+	meta, err := json.Marshal(e)
+	if err != nil {
+		panic(err) // entries can always be encoded
+	}
+	size := int64(len(meta) + 1 + len(e.Body))
+	if size > s.maxSize {
+		return
+	}
+
+	if err := s.write(diskCacheFilename(e.Key), meta, e.Body); err != nil {
+		log.Printf("failed to write cache file: %v", err)
+	}
+}
+
+func (s *diskCacheStore) write(name string, meta, body []byte) error {
+	f, err := os.CreateTemp(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(append(append(meta, '\n'), body...))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(meta) + 1 + len(body))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Rename(f.Name(), filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	if elem, ok := s.files[name]; ok {
+		s.lru.Remove(elem)
+		s.size -= elem.Value.(*diskCacheFile).size
+	}
+	s.files[name] = s.lru.PushFront(&diskCacheFile{name, size})
+	s.size += size
+	s.evictLocked()
+	return nil
+}
+
+func (s *diskCacheStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(diskCacheFilename(key))
+}
+
+func (s *diskCacheStore) removeLocked(name string) {
+	elem, ok := s.files[name]
+	if !ok {
+		return
+	}
+	s.lru.Remove(elem)
+	delete(s.files, name)
+	s.size -= elem.Value.(*diskCacheFile).size
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to remove cache file: %v", err)
+	}
+}
+
+// evictLocked removes the least recently used files until the maximum size
+// isn't exceeded anymore.
+func (s *diskCacheStore) evictLocked() {
+	for s.size > s.maxSize && s.lru.Len() > 0 {
+		s.removeLocked(s.lru.Back().Value.(*diskCacheFile).name)
+	}
+}
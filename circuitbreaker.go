@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitOpenError is returned when a request is rejected because the
+// circuit breaker is open.
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (err *circuitOpenError) Error() string {
+	return "circuit breaker open"
+}
+
+// circuitBreaker stops sending requests to an upstream server when too many
+// of them fail. After a while, a few probe requests are let through, and the
+// circuit is closed again if they succeed.
+type circuitBreaker struct {
+	errorRatio       float64
+	latency          time.Duration // 0 if disabled
+	minRequests      int
+	window           time.Duration
+	breakDuration    time.Duration
+	halfOpenRequests int
+
+	state atomic.Pointer[circuitBreakerState]
+}
+
+type circuitBreakerState struct {
+	mu          sync.Mutex
+	state       circuitState
+	generation  uint64 // incremented on each state change
+	windowStart time.Time
+	total       int
+	failures    int
+	openedAt    time.Time
+	probes      int // in-flight requests while half-open
+}
+
+func parseCircuitBreaker(dir *scfg.Directive) (*circuitBreaker, error) {
+	cb := &circuitBreaker{
+		errorRatio:       0.5,
+		minRequests:      10,
+		window:           10 * time.Second,
+		breakDuration:    30 * time.Second,
+		halfOpenRequests: 1,
+	}
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "error_ratio":
+			var s string
+			if err := child.ParseParams(&s); err != nil {
+				return nil, err
+			}
+			ratio, err := strconv.ParseFloat(s, 64)
+			if err != nil || ratio <= 0 || ratio > 1 {
+				return nil, fmt.Errorf("directive %q: invalid ratio %q", child.Name, s)
+			}
+			cb.errorRatio = ratio
+		case "min_requests", "half_open_requests":
+			var s string
+			if err := child.ParseParams(&s); err != nil {
+				return nil, err
+			}
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("directive %q: invalid number %q", child.Name, s)
+			}
+			if child.Name == "min_requests" {
+				cb.minRequests = n
+			} else {
+				cb.halfOpenRequests = n
+			}
+		case "latency", "window", "break_duration":
+			var durationStr string
+			if err := child.ParseParams(&durationStr); err != nil {
+				return nil, err
+			}
+			d, err := time.ParseDuration(durationStr)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			} else if d <= 0 {
+				return nil, fmt.Errorf("directive %q: duration must be positive", child.Name)
+			}
+			switch child.Name {
+			case "latency":
+				cb.latency = d
+			case "window":
+				cb.window = d
+			case "break_duration":
+				cb.breakDuration = d
+			}
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+
+	cb.state.Store(&circuitBreakerState{})
+	return cb, nil
+}
+
+// takeOver makes the circuit breaker share the state of an older one.
+func (cb *circuitBreaker) takeOver(old *circuitBreaker) {
+	cb.state.Store(old.state.Load())
+}
+
+// circuitToken identifies a request allowed by a circuit breaker.
+type circuitToken struct {
+	generation uint64
+	probe      bool
+}
+
+// setState changes the state of the circuit. The lock must be held.
+func (st *circuitBreakerState) setState(state circuitState) {
+	st.state = state
+	st.generation++
+}
+
+// allow checks whether a request can be sent. If it returns a nil error, done
+// must be called with the returned token and the outcome of the request, or
+// release if there is no outcome.
+func (cb *circuitBreaker) allow(now time.Time) (circuitToken, error) {
+	st := cb.state.Load()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	switch st.state {
+	case circuitOpen:
+		if wait := st.openedAt.Add(cb.breakDuration).Sub(now); wait > 0 {
+			return circuitToken{}, &circuitOpenError{retryAfter: wait}
+		}
+		st.setState(circuitHalfOpen)
+		st.probes = 0
+		fallthrough
+	case circuitHalfOpen:
+		if st.probes >= cb.halfOpenRequests {
+			return circuitToken{}, &circuitOpenError{retryAfter: time.Second}
+		}
+		st.probes++
+		return circuitToken{generation: st.generation, probe: true}, nil
+	}
+	return circuitToken{generation: st.generation}, nil
+}
+
+// done records the outcome of a request allowed by allow.
+func (cb *circuitBreaker) done(tok circuitToken, now time.Time, failed bool, latency time.Duration) {
+	if cb.latency > 0 && latency > cb.latency {
+		failed = true
+	}
+
+	st := cb.state.Load()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if tok.generation != st.generation {
+		// Request sent before the last state change, e.g. before the
+		// circuit has been opened: its outcome is outdated
+		return
+	}
+
+	if tok.probe {
+		st.probes--
+		if failed {
+			st.setState(circuitOpen)
+			st.openedAt = now
+		} else if st.probes == 0 {
+			st.setState(circuitClosed)
+			st.windowStart = now
+			st.total = 0
+			st.failures = 0
+		}
+		return
+	}
+
+	if now.Sub(st.windowStart) >= cb.window {
+		st.windowStart = now
+		st.total = 0
+		st.failures = 0
+	}
+	st.total++
+	if failed {
+		st.failures++
+	}
+	if st.total >= cb.minRequests && float64(st.failures) >= cb.errorRatio*float64(st.total) {
+		st.setState(circuitOpen)
+		st.openedAt = now
+	}
+}
+
+// release gives back a token allowed by allow without recording an outcome,
+// e.g. because the request has been canceled by the client. If it was a
+// probe, another one can be sent.
+func (cb *circuitBreaker) release(tok circuitToken) {
+	if !tok.probe {
+		return
+	}
+
+	st := cb.state.Load()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if tok.generation == st.generation {
+		st.probes--
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_releaseProbe(t *testing.T) {
+	cb := &circuitBreaker{
+		errorRatio:       0.5,
+		minRequests:      1,
+		window:           time.Minute,
+		breakDuration:    time.Second,
+		halfOpenRequests: 1,
+	}
+	cb.state.Store(&circuitBreakerState{})
+
+	now := time.Now()
+	tok, err := cb.allow(now)
+	if err != nil {
+		t.Fatalf("allow() = %v", err)
+	}
+	cb.done(tok, now, true, 0)
+	if _, err := cb.allow(now); err == nil {
+		t.Fatalf("allow() succeeded while open")
+	}
+
+	now = now.Add(2 * time.Second)
+	tok, err = cb.allow(now)
+	if err != nil || !tok.probe {
+		t.Fatalf("allow() = %+v, %v, want a probe", tok, err)
+	}
+	// The probe is canceled: the circuit stays half-open
+	cb.release(tok)
+	if state := cb.state.Load().state; state != circuitHalfOpen {
+		t.Fatalf("got state %v after release, want half-open", state)
+	}
+
+	tok, err = cb.allow(now)
+	if err != nil || !tok.probe {
+		t.Fatalf("allow() = %+v, %v, want another probe", tok, err)
+	}
+	cb.done(tok, now, false, 0)
+	if state := cb.state.Load().state; state != circuitClosed {
+		t.Fatalf("got state %v after a successful probe, want closed", state)
+	}
+}
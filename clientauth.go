@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+// clientAuth enforces client certificate authentication, based on the
+// verification results reported by the TLS terminator in the PROXY protocol
+// header.
+type clientAuth struct {
+	require   bool
+	allowedCN map[string]bool
+	paths     []string
+}
+
+func parseClientAuth(dir *scfg.Directive) (*clientAuth, error) {
+	ca := &clientAuth{require: true}
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "mode":
+			var mode string
+			if err := child.ParseParams(&mode); err != nil {
+				return nil, err
+			}
+			switch mode {
+			case "require":
+				ca.require = true
+			case "optional":
+				ca.require = false
+			default:
+				return nil, fmt.Errorf("unknown mode %q", mode)
+			}
+		case "allow_cn":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			if ca.allowedCN == nil {
+				ca.allowedCN = make(map[string]bool)
+			}
+			for _, cn := range child.Params {
+				ca.allowedCN[cn] = true
+			}
+		case "path":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			ca.paths = append(ca.paths, child.Params...)
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+	return ca, nil
+}
+
+func (ca *clientAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The incoming request's header is not trusted
+		r.Header.Del("X-Client-Cert-Verify")
+		r.Header.Del("X-Client-Cert-Subject-CN")
+
+		clientCert := contextClientCert(r.Context())
+		verify := "NONE"
+		if clientCert != nil && clientCert.presented {
+			if clientCert.verified {
+				verify = "SUCCESS"
+			} else {
+				verify = "FAILED"
+			}
+		}
+
+		verified := verify == "SUCCESS"
+		allowed := verified && (ca.allowedCN == nil || ca.allowedCN[clientCert.commonName])
+		if allowed {
+			r.Header.Set("X-Client-Cert-Verify", verify)
+			if clientCert.commonName != "" {
+				r.Header.Set("X-Client-Cert-Subject-CN", clientCert.commonName)
+			}
+		} else if verified {
+			r.Header.Set("X-Client-Cert-Verify", "FAILED")
+		} else {
+			r.Header.Set("X-Client-Cert-Verify", verify)
+		}
+
+		enforce := ca.require && (len(ca.paths) == 0 || matchPath(ca.paths, requestPath(r)))
+		if enforce && !allowed && !accessGranted(r.Context()) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
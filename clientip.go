@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+func parseTrustedProxies(params []string) ([]netip.Prefix, error) {
+	rules, err := parseAccessRules(true, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefixes []netip.Prefix
+	for _, rule := range rules {
+		if rule.all {
+			prefixes = append(prefixes, netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0"))
+		} else {
+			prefixes = append(prefixes, rule.prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// defaultClientIPHeader is the header field used to determine the client IP
+// address when a request is received from a trusted proxy.
+const defaultClientIPHeader = "X-Forwarded-For"
+
+// parseClientIPHeader parses the header child directive of trusted_proxies.
+func parseClientIPHeader(dir *scfg.Directive) (string, error) {
+	var name string
+	if err := dir.ParseParams(&name); err != nil {
+		return "", err
+	}
+	name = http.CanonicalHeaderKey(name)
+	switch name {
+	case "Forwarded", "X-Forwarded-For", "X-Real-Ip":
+		return name, nil
+	default:
+		return "", fmt.Errorf("unsupported header field %q", name)
+	}
+}
+
+func isTrustedProxy(trusted []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClientIP returns the IP address of the client which originated the
+// request. Reverse proxy header fields are only taken into account if the
+// request has been received from a trusted proxy, in which case the chain of
+// proxies found in the specified header field is walked from right to left
+// until an untrusted address is found. Other header fields are ignored: they
+// may have been sent by the client and passed through by the proxy.
+func resolveClientIP(r *http.Request, trusted []netip.Prefix, header string) netip.Addr {
+	peer := remoteIP(r)
+	if !peer.IsValid() || !isTrustedProxy(trusted, peer) {
+		return peer
+	}
+
+	var chain []string
+	switch header {
+	case "Forwarded":
+		chain = parseForwardedFor(r.Header.Values("Forwarded"))
+	case "X-Real-Ip":
+		if v := r.Header.Get("X-Real-IP"); v != "" {
+			chain = []string{strings.TrimSpace(v)}
+		}
+	default:
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, elem := range strings.Split(v, ",") {
+				chain = append(chain, strings.TrimSpace(elem))
+			}
+		}
+	}
+
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseNodeIP(chain[i])
+		if !ip.IsValid() {
+			// Unknown or obfuscated identifier: we can't go further
+			break
+		}
+		client = ip
+		if !isTrustedProxy(trusted, ip) {
+			break
+		}
+	}
+	return client
+}
+
+// parseForwardedFor extracts the "for" parameters from Forwarded header
+// fields, as defined in RFC 7239.
+func parseForwardedFor(values []string) []string {
+	var l []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(k, "for") {
+					continue
+				}
+				l = append(l, strings.Trim(v, `"`))
+			}
+		}
+	}
+	return l
+}
+
+// parseNodeIP parses an IP address optionally followed by a port, as found in
+// X-Forwarded-For and Forwarded header fields.
+func parseNodeIP(s string) netip.Addr {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap()
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, _ := netip.ParseAddr(s)
+	return addr.Unmap()
+}
+
+// formatForwardedNode formats a remote address as a node identifier
+// suitable for the Forwarded header field.
+func formatForwardedNode(remoteAddr string) string {
+	if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return addrPort.String()
+	}
+	ip := parseRemoteAddr(remoteAddr)
+	if !ip.IsValid() {
+		return "unknown"
+	} else if ip.Is6() {
+		return "[" + ip.String() + "]"
+	}
+	return ip.String()
+}
+
+const contextKeyTrustedPeer contextKey = "trustedPeer"
+
+// contextTrustedPeer returns the remote address of the peer if it's a
+// trusted proxy, or an empty string otherwise.
+func contextTrustedPeer(ctx context.Context) string {
+	peer, _ := ctx.Value(contextKeyTrustedPeer).(string)
+	return peer
+}
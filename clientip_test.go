@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		header     string
+		fields     map[string]string
+		want       string
+	}{
+		{
+			name:       "untrusted peer",
+			remoteAddr: "192.0.2.1:1234",
+			fields:     map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "x-forwarded-for",
+			remoteAddr: "10.0.0.1:1234",
+			fields:     map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "spoofed chain",
+			remoteAddr: "10.0.0.1:1234",
+			fields:     map[string]string{"X-Forwarded-For": "10.0.0.3, 198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "forwarded sent by the client",
+			remoteAddr: "10.0.0.1:1234",
+			fields: map[string]string{
+				"Forwarded":       "for=203.0.113.1",
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			want: "198.51.100.1",
+		},
+		{
+			name:       "forwarded",
+			remoteAddr: "10.0.0.1:1234",
+			header:     "Forwarded",
+			fields: map[string]string{
+				"Forwarded":       `for="[2001:db8::1]:4711", for=10.0.0.2`,
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			want: "2001:db8::1",
+		},
+		{
+			name:       "x-real-ip",
+			remoteAddr: "10.0.0.1:1234",
+			header:     "X-Real-Ip",
+			fields: map[string]string{
+				"X-Real-IP":       "198.51.100.1",
+				"X-Forwarded-For": "203.0.113.1",
+			},
+			want: "198.51.100.1",
+		},
+		{
+			name:       "missing header field",
+			remoteAddr: "10.0.0.1:1234",
+			fields:     map[string]string{"Forwarded": "for=203.0.113.1"},
+			want:       "10.0.0.1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for k, v := range tc.fields {
+				r.Header.Set(k, v)
+			}
+			header := tc.header
+			if header == "" {
+				header = defaultClientIPHeader
+			}
+			if got := resolveClientIP(r, trusted, header); got.String() != tc.want {
+				t.Errorf("resolveClientIP() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
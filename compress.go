@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~emersion/go-scfg"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+var defaultCompressTypes = []string{
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/javascript",
+	"application/javascript",
+	"application/x-javascript",
+	"application/json",
+	"application/atom+xml",
+	"application/rss+xml",
+	"image/svg+xml",
+}
+
+type compressEncoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressAlgorithm describes a content coding.
+type compressAlgorithm struct {
+	minLevel, maxLevel, defaultLevel int
+	newEncoder                       func(level int) compressEncoder
+}
+
+var compressAlgorithms = map[string]compressAlgorithm{
+	"gzip": {
+		minLevel:     gzip.BestSpeed,
+		maxLevel:     gzip.BestCompression,
+		defaultLevel: 5,
+		newEncoder: func(level int) compressEncoder {
+			w, err := gzip.NewWriterLevel(nil, level)
+			if err != nil {
+				panic(err) // level has already been checked
+			}
+			return w
+		},
+	},
+	"br": {
+		minLevel:     brotli.BestSpeed,
+		maxLevel:     brotli.BestCompression,
+		defaultLevel: 4,
+		newEncoder: func(level int) compressEncoder {
+			return brotli.NewWriterLevel(nil, level)
+		},
+	},
+	"zstd": {
+		minLevel:     1,
+		maxLevel:     22,
+		defaultLevel: 3,
+		newEncoder: func(level int) compressEncoder {
+			w, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+			if err != nil {
+				panic(err) // options are always valid
+			}
+			return w
+		},
+	},
+}
+
+// compressor compresses responses on the fly.
+type compressor struct {
+	encodings []string // by order of preference
+	types     []string
+	minSize   int
+	pools     map[string]*sync.Pool
+}
+
+func newCompressor(encodings []string, level int, types []string, minSize int) *compressor {
+	c := &compressor{
+		encodings: encodings,
+		types:     types,
+		minSize:   minSize,
+		pools:     make(map[string]*sync.Pool),
+	}
+	for _, name := range encodings {
+		alg := compressAlgorithms[name]
+		level := level
+		if level < 0 {
+			level = alg.defaultLevel
+		}
+		c.pools[name] = &sync.Pool{
+			New: func() interface{} {
+				return alg.newEncoder(level)
+			},
+		}
+	}
+	return c
+}
+
+func defaultCompressor() *compressor {
+	return newCompressor([]string{"gzip"}, -1, defaultCompressTypes, 0)
+}
+
+// parseCompress parses a compress directive. It returns nil if compression
+// is disabled.
+func parseCompress(dir *scfg.Directive) (*compressor, error) {
+	switch len(dir.Params) {
+	case 0:
+		// Compression enabled
+	case 1:
+		if dir.Params[0] != "off" {
+			return nil, fmt.Errorf("invalid parameter %q", dir.Params[0])
+		}
+		if len(dir.Children) > 0 {
+			return nil, fmt.Errorf("unexpected block")
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("expected at most one parameter")
+	}
+
+	encodings := []string{"gzip"}
+	level := -1
+	types := defaultCompressTypes
+	minSize := 0
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "algorithms":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			for _, name := range child.Params {
+				if _, ok := compressAlgorithms[name]; !ok {
+					return nil, fmt.Errorf("unknown compression algorithm %q", name)
+				}
+			}
+			encodings = child.Params
+		case "level":
+			var levelStr string
+			if err := child.ParseParams(&levelStr); err != nil {
+				return nil, err
+			}
+			var err error
+			level, err = strconv.Atoi(levelStr)
+			if err != nil || level < 0 {
+				return nil, fmt.Errorf("invalid level %q", levelStr)
+			}
+		case "min_size":
+			var sizeStr string
+			if err := child.ParseParams(&sizeStr); err != nil {
+				return nil, err
+			}
+			size, err := parseSize(sizeStr)
+			if err != nil {
+				return nil, err
+			}
+			minSize = int(size)
+		case "types":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			types = child.Params
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+
+	if level >= 0 {
+		for _, name := range encodings {
+			alg := compressAlgorithms[name]
+			if level < alg.minLevel || level > alg.maxLevel {
+				return nil, fmt.Errorf("invalid level %v for %v: must be between %v and %v", level, name, alg.minLevel, alg.maxLevel)
+			}
+		}
+	}
+
+	return newCompressor(encodings, level, types, minSize), nil
+}
+
+// negotiate selects a content coding from an Accept-Encoding header field.
+// It returns an empty string if none is acceptable.
+func (c *compressor) negotiate(acceptEncoding string) string {
+	qvalues := parseAcceptEncoding(acceptEncoding)
+	for _, name := range c.encodings {
+		if acceptsEncoding(qvalues, name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header field into a map of
+// content codings to quality values.
+func parseAcceptEncoding(acceptEncoding string) map[string]float64 {
+	qvalues := make(map[string]float64)
+	for _, elem := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(elem, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if name != "" {
+			qvalues[name] = q
+		}
+	}
+	return qvalues
+}
+
+func acceptsEncoding(qvalues map[string]float64, name string) bool {
+	q, ok := qvalues[name]
+	if !ok {
+		q, ok = qvalues["*"]
+	}
+	return ok && q > 0
+}
+
+func (c *compressor) compressible(contentType string) bool {
+	return matchMediaType(c.types, contentType)
+}
+
+// matchMediaType checks whether a Content-Type header field matches one of
+// the media types. Types may end with "/*" to match any subtype.
+func matchMediaType(types []string, contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	for _, t := range types {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *compressor) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressRW{
+			ResponseWriter: w,
+			c:              c,
+			encoding:       c.negotiate(r.Header.Get("Accept-Encoding")),
+		}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressRW compresses the response if it's eligible. If a minimum size is
+// configured, the beginning of the response is buffered until the decision
+// can be made.
+type compressRW struct {
+	http.ResponseWriter
+	c        *compressor
+	encoding string
+
+	status      int
+	wroteHeader bool // WriteHeader has been called on compressRW
+	decided     bool // WriteHeader has been called on ResponseWriter
+	hijacked    bool
+	buf         []byte
+	enc         compressEncoder
+}
+
+var (
+	_ http.Flusher  = (*compressRW)(nil)
+	_ http.Hijacker = (*compressRW)(nil)
+)
+
+func (w *compressRW) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressRW) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	if status < 200 {
+		// Informational responses are passed through as-is
+		w.ResponseWriter.WriteHeader(status)
+		if status == http.StatusSwitchingProtocols {
+			w.wroteHeader = true
+			w.decided = true
+		}
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	h := w.Header()
+	eligible := status == http.StatusOK &&
+		h.Get("Content-Encoding") == "" &&
+		!strings.Contains(h.Get("Cache-Control"), "no-transform") &&
+		w.c.compressible(h.Get("Content-Type"))
+	if eligible {
+		addVary(h, "Accept-Encoding")
+	}
+	if eligible && h.Get("Content-Length") != "" {
+		if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < w.c.minSize {
+			eligible = false
+		}
+	}
+	if !eligible || w.encoding == "" {
+		w.passthrough()
+	} else if w.c.minSize == 0 || h.Get("Content-Length") != "" {
+		w.startCompression()
+	}
+}
+
+func (w *compressRW) passthrough() {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *compressRW) startCompression() {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", w.encoding)
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+
+	w.enc = w.c.pools[w.encoding].Get().(compressEncoder)
+	w.enc.Reset(w.ResponseWriter)
+}
+
+func (w *compressRW) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	} else if w.decided {
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.c.minSize {
+		w.startCompression()
+		if err := w.flushBuffer(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *compressRW) flushBuffer() error {
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+func (w *compressRW) Flush() {
+	if !w.wroteHeader {
+		// Otherwise the header would be sent without Content-Encoding
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		// The response is streamed, compress it
+		w.startCompression()
+		w.flushBuffer()
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressRW) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, brw, err
+}
+
+func (w *compressRW) close() {
+	if w.hijacked {
+		return
+	}
+	if w.wroteHeader && !w.decided {
+		// The response is smaller than the minimum size
+		w.Header().Set("Content-Length", strconv.Itoa(len(w.buf)))
+		w.passthrough()
+		w.flushBuffer()
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		w.enc.Reset(nil)
+		w.c.pools[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
+
+// addVary adds a field name to the Vary header field, if it's not already
+// present.
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, elem := range strings.Split(v, ",") {
+			elem = strings.TrimSpace(elem)
+			if elem == "*" || strings.EqualFold(elem, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
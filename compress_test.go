@@ -0,0 +1,40 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompress_flushBeforeWrite(t *testing.T) {
+	c := newCompressor([]string{"gzip"}, -1, defaultCompressTypes, 1024)
+	h := c.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "hello")
+		w.(http.Flusher).Flush()
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	// The header is sent by the first Flush
+	if ce := w.Result().Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want %q", ce, "gzip")
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("got body %q, want %q", b, "hello")
+	}
+}
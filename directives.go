@@ -1,15 +1,16 @@
 package main
 
 import (
-	"crypto/subtle"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -50,10 +51,46 @@ func parseConfig(srv *Server, cfg scfg.Block) error {
 			}
 			// TODO: close this when we support closing the server without exiting in the future
 			srv.accessLogs = f
+		case "trusted_proxies":
+			trusted, err := parseTrustedProxies(dir.Params)
+			if err != nil {
+				return fmt.Errorf("directive %q: %v", dir.Name, err)
+			}
+			srv.trustedProxies = append(srv.trustedProxies, trusted...)
+
+			for _, child := range dir.Children {
+				switch child.Name {
+				case "header":
+					header, err := parseClientIPHeader(child)
+					if err != nil {
+						return fmt.Errorf("directive %q: directive %q: %v", dir.Name, child.Name, err)
+					}
+					if srv.clientIPHeader != "" && srv.clientIPHeader != header {
+						return fmt.Errorf("directive %q: conflicting header fields %q and %q", dir.Name, srv.clientIPHeader, header)
+					}
+					srv.clientIPHeader = header
+				default:
+					return fmt.Errorf("directive %q: unknown child directive %q", dir.Name, child.Name)
+				}
+			}
 		default:
 			return fmt.Errorf("unknown directive %q", dir.Name)
 		}
 	}
+
+	if srv.clientAuth && len(srv.trustedProxies) == 0 {
+		// Client certificates are only accepted via the PROXY protocol
+		return fmt.Errorf("directive \"client_auth\" requires a \"trusted_proxies\" directive")
+	}
+
+	clientIPHeader := srv.clientIPHeader
+	if clientIPHeader == "" {
+		clientIPHeader = defaultClientIPHeader
+	}
+	for _, ln := range srv.listeners {
+		ln.SetTrustedProxies(srv.trustedProxies, clientIPHeader)
+	}
+
 	return nil
 }
 
@@ -96,6 +133,15 @@ func parseSite(srv *Server, dir *scfg.Directive) error {
 
 		pattern := host + path
 
+		sc := &siteConfig{
+			srv:     srv,
+			ln:      ln,
+			pattern: pattern,
+			path:    path,
+
+			compress: defaultCompressor(),
+		}
+
 		// First process backend directives
 		var backend http.Handler
 		for _, child := range dir.Children {
@@ -108,7 +154,7 @@ func parseSite(srv *Server, dir *scfg.Directive) error {
 				return fmt.Errorf("site %q: multiple HTTP backend directives provided", site)
 			}
 
-			backend, err = f(child)
+			backend, err = f(sc, child)
 			if err != nil {
 				return fmt.Errorf("site %q: %v", site, err)
 			}
@@ -125,11 +171,27 @@ func parseSite(srv *Server, dir *scfg.Directive) error {
 				continue
 			}
 
-			handler, err = parseMiddleware(child, handler)
+			handler, err = parseMiddleware(sc, child, handler)
 			if err != nil {
 				return fmt.Errorf("site %q: directive %q: %v", site, child.Name, err)
 			}
 		}
+		for _, c := range sc.caches {
+			c.auth = sc.auth
+		}
+		if sc.access != nil {
+			if len(sc.access.rules) == 0 {
+				return fmt.Errorf("site %q: directive \"satisfy\" requires \"allow\" or \"deny\" directives", site)
+			}
+			sc.access.auth = sc.auth
+			handler = sc.access.middleware(handler)
+		}
+		if sc.errorPages != nil {
+			handler = sc.errorPages.middleware(handler)
+		}
+		if sc.compress != nil {
+			handler = sc.compress.middleware(handler)
+		}
 		if !insecure {
 			next := handler
 			handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -157,7 +219,7 @@ func parseSite(srv *Server, dir *scfg.Directive) error {
 					scheme = "https"
 				}
 				host := host
-				if h := r.Header.Get("Host"); h != "" {
+				if h := r.Host; h != "" {
 					host = h
 				}
 				referer := r.Header.Get("Referer")
@@ -176,7 +238,7 @@ func parseSite(srv *Server, dir *scfg.Directive) error {
 					host,
 					r.RequestURI,
 					r.Proto,
-					interceptWriter.status,
+					grpcStatus(interceptWriter.Header(), interceptWriter.status),
 					interceptWriter.size,
 					referer,
 					userAgent,
@@ -190,69 +252,50 @@ func parseSite(srv *Server, dir *scfg.Directive) error {
 	return nil
 }
 
-type parseBackendFunc func(dir *scfg.Directive) (http.Handler, error)
+// siteConfig holds the state shared by the directives of a single site.
+type siteConfig struct {
+	srv     *Server
+	ln      *Listener
+	pattern string
+	path    string // stripped from requests before they reach directives
 
-var backends = map[string]parseBackendFunc{
-	"file_server": func(dir *scfg.Directive) (http.Handler, error) {
-		var dirname string
-		if err := dir.ParseParams(&dirname); err != nil {
-			return nil, err
-		}
-		var fs http.FileSystem = http.Dir(dirname)
-		if dir.Children.Get("browse") == nil {
-			fs = noBrowseFileSystem{fs}
-		}
-		return http.FileServer(fs), nil
-	},
-	"reverse_proxy": func(dir *scfg.Directive) (http.Handler, error) {
-		var urlStr string
-		if err := dir.ParseParams(&urlStr); err != nil {
-			return nil, err
-		}
-		target, err := url.Parse(urlStr)
-		if err != nil {
-			return nil, err
-		}
-		director := func(req *http.Request) {
-			proto := "http"
-			if contextTLSState(req.Context()) != nil {
-				proto = "https"
-			}
+	keyPrefix string // distinguishes nested backends, e.g. split choices
 
-			forwarded := fmt.Sprintf("for=%q;host=%q;proto=%q", req.RemoteAddr, req.Host, proto)
-			forwardedForHost, _, _ := net.SplitHostPort(req.RemoteAddr)
+	access *accessControl
+	auth   bool // whether an authentication directive is present
+	caches []*httpCache
 
-			req.URL.Scheme = target.Scheme
-			req.URL.Host = target.Host
-			if strings.HasSuffix(target.Path, "/") {
-				p := path.Join("/", req.URL.Path)
-				if strings.HasSuffix(req.URL.Path, "/") && !strings.HasSuffix(p, "/") {
-					p += "/"
-				}
-				req.URL.Path = strings.TrimSuffix(target.Path, "/") + p
-			} else {
-				req.URL.Path = target.Path
-			}
-			if target.RawQuery == "" || req.URL.RawQuery == "" {
-				req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
-			} else {
-				req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
-			}
+	compress    *compressor // nil if compression is disabled
+	compressSet bool
 
-			// Override reverse proxy header fields: the incoming request's
-			// header is not trusted
-			req.Header.Set("Forwarded", forwarded)
-			if forwardedForHost != "" {
-				req.Header.Set("X-Forwarded-For", forwardedForHost)
-			} else {
-				req.Header.Del("X-Forwarded-For")
-			}
-			req.Header.Set("X-Forwarded-Host", req.Host)
-			req.Header.Set("X-Forwarded-Proto", proto)
-		}
-		return &httputil.ReverseProxy{Director: director}, nil
-	},
-	"redirect": func(dir *scfg.Directive) (http.Handler, error) {
+	errorPages *errorPages
+}
+
+func (sc *siteConfig) accessControl() *accessControl {
+	if sc.access == nil {
+		sc.access = &accessControl{}
+	}
+	return sc.access
+}
+
+// key returns a string uniquely identifying a directive of the site, used to
+// carry state over config reloads.
+func (sc *siteConfig) key(dir *scfg.Directive) string {
+	var sb strings.Builder
+	sb.WriteString(sc.ln.Network + " " + sc.ln.Address + " " + sc.pattern + "\n")
+	sb.WriteString(sc.keyPrefix)
+	scfg.Write(&sb, scfg.Block{dir})
+	return sb.String()
+}
+
+type parseBackendFunc func(sc *siteConfig, dir *scfg.Directive) (http.Handler, error)
+
+var backends = map[string]parseBackendFunc{
+	"file_server":   parseFileServer,
+	"webdav":        parseWebDAV,
+	"reverse_proxy": parseReverseProxy,
+	"metrics":       parseMetrics,
+	"redirect": func(sc *siteConfig, dir *scfg.Directive) (http.Handler, error) {
 		var to string
 		if err := dir.ParseParams(&to); err != nil {
 			return nil, err
@@ -261,7 +304,7 @@ var backends = map[string]parseBackendFunc{
 	},
 }
 
-func parseMiddleware(dir *scfg.Directive, next http.Handler) (http.Handler, error) {
+func parseMiddleware(sc *siteConfig, dir *scfg.Directive, next http.Handler) (http.Handler, error) {
 	switch dir.Name {
 	case "header":
 		// TODO: allow adding and removing fields
@@ -290,23 +333,124 @@ func parseMiddleware(dir *scfg.Directive, next http.Handler) (http.Handler, erro
 			next.ServeHTTP(w, r)
 		}), nil
 	case "basic_auth":
-		var username, password string
-		if err := dir.ParseParams(&username, &password); err != nil {
+		ba, err := parseBasicAuth(dir)
+		if err != nil {
+			return nil, err
+		}
+		sc.auth = true
+		return ba.middleware(next), nil
+	case "auth_request":
+		ar, err := parseAuthRequest(dir)
+		if err != nil {
+			return nil, err
+		}
+		sc.auth = true
+		return ar.middleware(next), nil
+	case "oidc":
+		oa, err := parseOIDC(sc, dir)
+		if err != nil {
+			return nil, err
+		}
+		sc.auth = true
+		return oa.middleware(next), nil
+	case "client_auth":
+		ca, err := parseClientAuth(dir)
+		if err != nil {
+			return nil, err
+		}
+		sc.auth = true
+		sc.srv.clientAuth = true
+		return ca.middleware(next), nil
+	case "allow", "deny":
+		rules, err := parseAccessRules(dir.Name == "allow", dir.Params)
+		if err != nil {
+			return nil, err
+		}
+		ac := sc.accessControl()
+		ac.rules = append(ac.rules, rules...)
+		return next, nil
+	case "satisfy":
+		var mode string
+		if err := dir.ParseParams(&mode); err != nil {
 			return nil, err
 		}
+		switch mode {
+		case "all":
+			sc.accessControl().satisfyAny = false
+		case "any":
+			sc.accessControl().satisfyAny = true
+		default:
+			return nil, fmt.Errorf("unknown mode %q", mode)
+		}
+		return next, nil
+	case "compress":
+		if sc.compressSet {
+			return nil, fmt.Errorf("only one directive of this kind is allowed")
+		}
+		c, err := parseCompress(dir)
+		if err != nil {
+			return nil, err
+		}
+		sc.compress = c
+		sc.compressSet = true
+		return next, nil
+	case "error_pages":
+		if sc.errorPages != nil {
+			return nil, fmt.Errorf("only one directive of this kind is allowed")
+		}
+		ep, err := parseErrorPages(dir)
+		if err != nil {
+			return nil, err
+		}
+		sc.errorPages = ep
+		return next, nil
+	case "rate_limit":
+		rl, err := parseRateLimit(dir)
+		if err != nil {
+			return nil, err
+		}
+		if rl.keyUser && sc.auth {
+			// The user wouldn't be authenticated yet
+			return nil, fmt.Errorf("key \"user\" requires the directive to be listed before authentication directives")
+		}
 
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			u, p, ok := r.BasicAuth()
-			usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(u))
-			passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(p))
-			if !ok || (usernameOK&passwordOK) != 1 {
-				w.Header().Set("WWW-Authenticate", "Basic")
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
+		k := sc.key(dir)
+		if _, ok := sc.srv.rateLimiters[k]; ok {
+			return nil, fmt.Errorf("duplicate directive")
+		}
+		sc.srv.rateLimiters[k] = rl
 
-			next.ServeHTTP(w, r)
-		}), nil
+		return rl.middleware(next), nil
+	case "request_body":
+		cfg, err := parseRequestBody(dir)
+		if err != nil {
+			return nil, err
+		}
+		return cfg.middleware(next), nil
+	case "cache":
+		c, err := parseCache(dir)
+		if err != nil {
+			return nil, err
+		}
+		if sc.auth {
+			// Stored responses would be served without authentication
+			return nil, fmt.Errorf("directive must be listed before authentication directives")
+		}
+
+		k := sc.key(dir)
+		if _, ok := sc.srv.caches[k]; ok {
+			return nil, fmt.Errorf("duplicate directive")
+		}
+		sc.srv.caches[k] = c
+		sc.caches = append(sc.caches, c)
+
+		return c.middleware(next), nil
+	case "mirror":
+		m, err := parseMirror(dir)
+		if err != nil {
+			return nil, err
+		}
+		return m.middleware(next), nil
 	default:
 		return nil, fmt.Errorf("unknown directive")
 	}
@@ -384,3 +528,70 @@ type noBrowseFile struct {
 func (f noBrowseFile) Readdir(count int) ([]os.FileInfo, error) {
 	return nil, os.ErrPermission
 }
+
+// parseSize parses a size in bytes, optionally followed by a unit such as
+// "KB", "MB" or "GB". Units are powers of 1024.
+func parseSize(s string) (int64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	var shift uint
+	switch strings.ToUpper(strings.TrimSpace(s[i:])) {
+	case "", "B":
+		shift = 0
+	case "K", "KB", "KIB":
+		shift = 10
+	case "M", "MB", "MIB":
+		shift = 20
+	case "G", "GB", "GIB":
+		shift = 30
+	default:
+		return 0, fmt.Errorf("invalid size %q: unknown unit", s)
+	}
+	if n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return n << shift, nil
+}
+
+// requestPath returns the path of the request, relative to the site path.
+func requestPath(r *http.Request) string {
+	return "/" + strings.TrimPrefix(r.URL.Path, "/")
+}
+
+// matchPath checks whether a path matches any of the patterns. Patterns use
+// the path.Match syntax, and patterns ending with a slash match all paths
+// beginning with the pattern.
+func matchPath(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(p, pattern) {
+			return true
+		}
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of the client. The zero value is returned
+// if it cannot be determined.
+func remoteIP(r *http.Request) netip.Addr {
+	return parseRemoteAddr(r.RemoteAddr)
+}
+
+func parseRemoteAddr(remoteAddr string) netip.Addr {
+	if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return addrPort.Addr().Unmap()
+	}
+	addr, _ := netip.ParseAddr(remoteAddr)
+	return addr.Unmap()
+}
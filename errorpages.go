@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+const contextKeyUpstreamResponse contextKey = "upstreamResponse"
+
+// markUpstreamResponse records that the response to a request has been
+// produced by a reverse proxy upstream.
+func markUpstreamResponse(ctx context.Context) {
+	if p, ok := ctx.Value(contextKeyUpstreamResponse).(*bool); ok {
+		*p = true
+	}
+}
+
+// isUpstreamResponse checks whether markUpstreamResponse has been called.
+func isUpstreamResponse(ctx context.Context) bool {
+	p, ok := ctx.Value(contextKeyUpstreamResponse).(*bool)
+	return ok && *p
+}
+
+// Header fields describing the original response body, removed when
+// replacing it with an error page. Other header fields are kept, e.g. the
+// ones set by the header directive.
+var errorPageRemovedHeaders = []string{
+	"Accept-Ranges",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"ETag",
+	"Last-Modified",
+	"Transfer-Encoding",
+}
+
+type errorPages struct {
+	byStatus          map[int]string
+	byClass           map[int]string // e.g. 5 for 5xx
+	interceptUpstream bool
+}
+
+func parseErrorPages(dir *scfg.Directive) (*errorPages, error) {
+	ep := &errorPages{
+		byStatus: make(map[int]string),
+		byClass:  make(map[int]string),
+	}
+	for _, child := range dir.Children {
+		if child.Name == "intercept_upstream" {
+			ep.interceptUpstream = true
+			continue
+		}
+
+		var filename string
+		if err := child.ParseParams(&filename); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(filename); err != nil {
+			return nil, err
+		}
+
+		if len(child.Name) == 3 && child.Name[1:] == "xx" && child.Name[0] >= '4' && child.Name[0] <= '5' {
+			class := int(child.Name[0] - '0')
+			if _, ok := ep.byClass[class]; ok {
+				return nil, fmt.Errorf("duplicate child directive %q", child.Name)
+			}
+			ep.byClass[class] = filename
+			continue
+		}
+
+		status, err := strconv.Atoi(child.Name)
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("invalid status code %q", child.Name)
+		}
+		if _, ok := ep.byStatus[status]; ok {
+			return nil, fmt.Errorf("duplicate child directive %q", child.Name)
+		}
+		ep.byStatus[status] = filename
+	}
+	return ep, nil
+}
+
+func (ep *errorPages) lookup(status int) string {
+	if filename, ok := ep.byStatus[status]; ok {
+		return filename
+	}
+	return ep.byClass[status/100]
+}
+
+func (ep *errorPages) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var fromUpstream bool
+		ctx := context.WithValue(r.Context(), contextKeyUpstreamResponse, &fromUpstream)
+		r = r.WithContext(ctx)
+
+		epw := &errorPageRW{
+			ResponseWriter: w,
+			ep:             ep,
+			fromUpstream:   &fromUpstream,
+		}
+		next.ServeHTTP(epw, r)
+	})
+}
+
+// errorPageRW replaces error responses with custom error pages.
+type errorPageRW struct {
+	http.ResponseWriter
+	ep           *errorPages
+	fromUpstream *bool
+
+	wroteHeader bool
+	intercepted bool
+}
+
+var (
+	_ http.Flusher  = (*errorPageRW)(nil)
+	_ http.Hijacker = (*errorPageRW)(nil)
+)
+
+func (w *errorPageRW) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *errorPageRW) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	if status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+
+	filename := ""
+	if status >= 400 && (!*w.fromUpstream || w.ep.interceptUpstream) {
+		filename = w.ep.lookup(status)
+	}
+	if filename == "" {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		log.Printf("failed to read error page: %v", err)
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.intercepted = true
+
+	h := w.Header()
+	for _, k := range errorPageRemovedHeaders {
+		h.Del(k)
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	if contentType == "" {
+		contentType = http.DetectContentType(b)
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(b)))
+	h.Set("Cache-Control", "no-store")
+	w.ResponseWriter.WriteHeader(status)
+	w.ResponseWriter.Write(b)
+}
+
+func (w *errorPageRW) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.intercepted {
+		// Discard the original body
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorPageRW) Flush() {
+	if w.intercepted {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *errorPageRW) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
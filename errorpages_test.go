@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+func TestErrorPages_keepHeaders(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "404.html")
+	if err := os.WriteFile(filename, []byte("<p>Not found</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := scfg.Read(strings.NewReader("error_pages {\n404 " + filename + "\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := parseErrorPages(cfg[0])
+	if err != nil {
+		t.Fatalf("parseErrorPages() = %v", err)
+	}
+
+	h := ep.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"abc"`)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("original body"))
+	}))
+	w := httptest.NewRecorder()
+	// Set by the router before the request reaches the site
+	w.Header().Set("X-Frame-Options", "sameorigin")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %v, want 404", resp.StatusCode)
+	}
+	if body := w.Body.String(); body != "<p>Not found</p>" {
+		t.Errorf("got body %q, want the error page", body)
+	}
+	for k, want := range map[string]string{
+		"X-Frame-Options":         "sameorigin",
+		"Content-Security-Policy": "default-src 'none'",
+		"Content-Type":            "text/html; charset=utf-8",
+		"Content-Encoding":        "",
+		"ETag":                    "",
+	} {
+		if v := resp.Header.Get(k); v != want {
+			t.Errorf("got %v %q, want %q", k, v, want)
+		}
+	}
+}
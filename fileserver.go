@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+// precompressedExts maps content codings to file name extensions.
+var precompressedExts = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+type fileServer struct {
+	fs            http.FileSystem
+	handler       http.Handler
+	browse        *directoryListing
+	precompressed []string // content codings by order of preference
+	tryFiles      []string // may contain a "{path}" placeholder
+	fallback      string
+	cacheRules    []*cacheRule
+	etags         *etagCache
+}
+
+func parseFileServer(sc *siteConfig, dir *scfg.Directive) (http.Handler, error) {
+	var dirname string
+	if err := dir.ParseParams(&dirname); err != nil {
+		return nil, err
+	}
+
+	srv := &fileServer{}
+	hide := defaultHidePatterns
+	symlinks := symlinkRoot
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "browse":
+			dl, err := parseBrowse(child)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			}
+			srv.browse = dl
+		case "precompressed":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			for _, enc := range child.Params {
+				if _, ok := precompressedExts[enc]; !ok {
+					return nil, fmt.Errorf("directive %q: unknown content coding %q", child.Name, enc)
+				}
+			}
+			srv.precompressed = child.Params
+		case "try_files":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			srv.tryFiles = append(srv.tryFiles, child.Params...)
+		case "fallback":
+			if err := child.ParseParams(&srv.fallback); err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(srv.fallback, "/") {
+				return nil, fmt.Errorf("directive %q: path must be absolute", child.Name)
+			}
+		case "cache_control", "expires":
+			rule, err := parseCacheRule(child)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			}
+			srv.cacheRules = append(srv.cacheRules, rule)
+		case "hide":
+			var err error
+			if hide, err = parseHide(child); err != nil {
+				return nil, err
+			}
+		case "symlinks":
+			var err error
+			if symlinks, err = parseSymlinks(child); err != nil {
+				return nil, err
+			}
+		case "etag":
+			if len(child.Params) > 0 || len(child.Children) > 0 {
+				return nil, fmt.Errorf("directive %q: unexpected parameters", child.Name)
+			}
+			srv.etags = newETagCache()
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+
+	fs, err := newRestrictedFileSystem(dirname, hide, symlinks)
+	if err != nil {
+		return nil, err
+	}
+	srv.fs = fs
+
+	// Directory listings are rendered by directoryListing instead
+	srv.handler = http.FileServer(noBrowseFileSystem{srv.fs})
+	return srv, nil
+}
+
+func (srv *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		srv.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if len(srv.tryFiles) > 0 || srv.fallback != "" {
+		r = srv.rewrite(r)
+	}
+
+	var name string
+	if len(srv.precompressed) > 0 || len(srv.cacheRules) > 0 || srv.etags != nil {
+		name = srv.resolve(r)
+	}
+
+	if name != "" && len(srv.cacheRules) > 0 {
+		srv.setCacheHeaders(w.Header(), name)
+	}
+
+	if len(srv.precompressed) > 0 {
+		addVary(w.Header(), "Accept-Encoding")
+		if name != "" && srv.servePrecompressed(w, r, name) {
+			return
+		}
+	}
+
+	if name != "" && srv.etags != nil {
+		// http.ServeContent handles conditional requests based on the ETag
+		if etag, err := srv.etags.get(srv.fs, name); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+	}
+
+	if srv.browse != nil && srv.browse.serve(w, r, srv.fs) {
+		return
+	}
+
+	srv.handler.ServeHTTP(w, r)
+}
+
+// setCacheHeaders applies the first cache rule matching a file.
+func (srv *fileServer) setCacheHeaders(h http.Header, name string) {
+	contentType, err := srv.contentType(name)
+	if err != nil {
+		return
+	}
+	for _, rule := range srv.cacheRules {
+		if rule.match(name, contentType) {
+			rule.apply(h)
+			return
+		}
+	}
+}
+
+// rewrite replaces the request path with the first existing file from the
+// try_files list or with the fallback, if the requested file doesn't exist.
+func (srv *fileServer) rewrite(r *http.Request) *http.Request {
+	name := path.Clean("/" + r.URL.Path)
+	if _, err := srv.stat(name); err == nil {
+		return r
+	}
+
+	var candidates []string
+	for _, pattern := range srv.tryFiles {
+		candidates = append(candidates, path.Clean("/"+strings.ReplaceAll(pattern, "{path}", name)))
+	}
+	if srv.fallback != "" {
+		candidates = append(candidates, srv.fallback)
+	}
+
+	for _, candidate := range candidates {
+		fi, err := srv.stat(candidate)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		// Avoid the redirection performed by http.FileServer for index
+		// files
+		if strings.HasSuffix(candidate, "/index.html") {
+			candidate = strings.TrimSuffix(candidate, "index.html")
+		}
+
+		u := *r.URL
+		u.Path = candidate
+		u.RawPath = ""
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = &u
+		return r2
+	}
+
+	return r
+}
+
+// resolve returns the name of the file which would be served by
+// http.FileServer for the request, or an empty string if the request
+// wouldn't result in a regular file being served (e.g. it would result in a
+// redirection or an error).
+func (srv *fileServer) resolve(r *http.Request) string {
+	urlPath := r.URL.Path
+	if !strings.HasPrefix(urlPath, "/") {
+		urlPath = "/" + urlPath
+	}
+	if strings.HasSuffix(urlPath, "/index.html") {
+		// http.FileServer redirects to the directory
+		return ""
+	}
+	name := path.Clean(urlPath)
+
+	fi, err := srv.stat(name)
+	if err != nil {
+		return ""
+	}
+	if fi.IsDir() {
+		if !strings.HasSuffix(urlPath, "/") {
+			return ""
+		}
+		name = path.Join(name, "index.html")
+		fi, err = srv.stat(name)
+		if err != nil {
+			return ""
+		}
+	}
+	if !fi.Mode().IsRegular() {
+		return ""
+	}
+	return name
+}
+
+func (srv *fileServer) stat(name string) (os.FileInfo, error) {
+	f, err := srv.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// servePrecompressed serves a precompressed variant of a file, if any
+// matches the client's Accept-Encoding header field.
+func (srv *fileServer) servePrecompressed(w http.ResponseWriter, r *http.Request, name string) bool {
+	qvalues := parseAcceptEncoding(r.Header.Get("Accept-Encoding"))
+	for _, enc := range srv.precompressed {
+		if !acceptsEncoding(qvalues, enc) {
+			continue
+		}
+
+		f, err := srv.fs.Open(name + precompressedExts[enc])
+		if err != nil {
+			continue
+		}
+
+		fi, err := f.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			f.Close()
+			continue
+		}
+
+		contentType, err := srv.contentType(name)
+		if err != nil {
+			f.Close()
+			return false
+		}
+
+		h := w.Header()
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Encoding", enc)
+		if srv.etags != nil {
+			// Each variant has its own representation, thus its own ETag
+			if etag, err := srv.etags.get(srv.fs, name+precompressedExts[enc]); err == nil {
+				h.Set("ETag", etag)
+			}
+		}
+		http.ServeContent(w, r, name, fi.ModTime(), f)
+		f.Close()
+		return true
+	}
+
+	return false
+}
+
+// contentType returns the media type of a file, like http.FileServer does.
+func (srv *fileServer) contentType(name string) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t, nil
+	}
+
+	f, err := srv.fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var buf [512]byte
+	n, err := io.ReadFull(f, buf[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
@@ -4,9 +4,15 @@ go 1.22.6
 
 require (
 	git.sr.ht/~emersion/go-scfg v0.0.0-20240128091534-2ae16e782082
+	github.com/andybalholm/brotli v1.1.1
 	github.com/go-chi/chi/v5 v5.1.0
+	github.com/klauspost/compress v1.17.11
 	github.com/pires/go-proxyproto v0.8.0
+	golang.org/x/crypto v0.28.0
 	golang.org/x/net v0.30.0
 )
 
-require golang.org/x/text v0.19.0 // indirect
+require (
+	golang.org/x/sys v0.26.0 // indirect
+	golang.org/x/text v0.19.0 // indirect
+)
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// MD5-crypt password hashing, as used by Apache's htpasswd ("$apr1$") and
+// historically by crypt(3) ("$1$").
+
+const md5CryptMaxSaltLen = 8
+
+// parseMD5Crypt parses a "$apr1$" or "$1$" hash, and returns the prefix and
+// the salt.
+func parseMD5Crypt(hashed string) (magic, salt string, err error) {
+	var rest string
+	if s, ok := strings.CutPrefix(hashed, "$apr1$"); ok {
+		magic, rest = "$apr1$", s
+	} else if s, ok := strings.CutPrefix(hashed, "$1$"); ok {
+		magic, rest = "$1$", s
+	} else {
+		return "", "", fmt.Errorf("not an MD5-crypt hash")
+	}
+
+	salt, _, ok := strings.Cut(rest, "$")
+	if !ok {
+		return "", "", fmt.Errorf("malformed MD5-crypt hash")
+	}
+	if len(salt) > md5CryptMaxSaltLen {
+		salt = salt[:md5CryptMaxSaltLen]
+	}
+	return magic, salt, nil
+}
+
+// checkMD5Crypt verifies a password against an MD5-crypt hash.
+func checkMD5Crypt(hashed, password string) (bool, error) {
+	magic, salt, err := parseMD5Crypt(hashed)
+	if err != nil {
+		return false, err
+	}
+	want := md5Crypt([]byte(magic), []byte(password), []byte(salt))
+	return subtle.ConstantTimeCompare([]byte(want), []byte(hashed)) == 1, nil
+}
+
+func md5Crypt(magic, password, salt []byte) string {
+	h := md5.New()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write(magic)
+	h.Write(salt)
+	h.Write(repeatBytes(b, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(password[:1])
+		}
+	}
+	c := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h.Reset()
+		if i%2 != 0 {
+			h.Write(password)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(salt)
+		}
+		if i%7 != 0 {
+			h.Write(password)
+		}
+		if i%2 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(password)
+		}
+		c = h.Sum(c[:0])
+	}
+
+	var sb strings.Builder
+	sb.Write(magic)
+	sb.Write(salt)
+	sb.WriteByte('$')
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		writeCryptBase64(&sb, uint(c[idx[0]])<<16|uint(c[idx[1]])<<8|uint(c[idx[2]]), 4)
+	}
+	writeCryptBase64(&sb, uint(c[11]), 2)
+	return sb.String()
+}
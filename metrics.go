@@ -0,0 +1,59 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+// metricsMaps holds the counters served by the metrics backend. They aren't
+// published via the expvar package, which would expose them along with the
+// process command line and memory statistics.
+var metricsMaps = make(map[string]*expvar.Map)
+
+// newMetrics creates a set of counters served by the metrics backend, starting
+// at zero. It must be called during package initialization.
+func newMetrics(name string, keys ...string) *expvar.Map {
+	if _, ok := metricsMaps[name]; ok {
+		panic(fmt.Sprintf("duplicate metrics %q", name))
+	}
+	m := new(expvar.Map)
+	for _, k := range keys {
+		m.Add(k, 0)
+	}
+	metricsMaps[name] = m
+	return m
+}
+
+func parseMetrics(sc *siteConfig, dir *scfg.Directive) (http.Handler, error) {
+	if len(dir.Params) > 0 || len(dir.Children) > 0 {
+		return nil, fmt.Errorf("unexpected parameters")
+	}
+	return http.HandlerFunc(serveMetrics), nil
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(metricsMaps))
+	for name := range metricsMaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%q: %v", name, metricsMaps[name].String())
+	}
+	sb.WriteString("}\n")
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(sb.String()))
+}
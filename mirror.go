@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+const (
+	mirrorDefaultMaxBody = 64 << 10
+	mirrorDefaultTimeout = 10 * time.Second
+
+	// mirrorMaxInflight is the maximum number of concurrent mirrored
+	// requests. Additional requests aren't mirrored.
+	mirrorMaxInflight = 128
+)
+
+var mirrorMetrics = newMetrics("mirror", "requests", "failures", "skipped", "dropped")
+
+// mirror duplicates incoming requests to another server. Responses are
+// discarded.
+type mirror struct {
+	target   *url.URL
+	percent  float64
+	maxBody  int64
+	client   *http.Client
+	inflight chan struct{}
+}
+
+func parseMirror(dir *scfg.Directive) (*mirror, error) {
+	var urlStr string
+	if err := dir.ParseParams(&urlStr); err != nil {
+		return nil, err
+	}
+	target, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URI scheme %q", target.Scheme)
+	}
+
+	m := &mirror{
+		target:   target,
+		percent:  100,
+		maxBody:  mirrorDefaultMaxBody,
+		inflight: make(chan struct{}, mirrorMaxInflight),
+	}
+	timeout := mirrorDefaultTimeout
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "percent":
+			var s string
+			if err := child.ParseParams(&s); err != nil {
+				return nil, err
+			}
+			percent, err := strconv.ParseFloat(s, 64)
+			if err != nil || percent <= 0 || percent > 100 {
+				return nil, fmt.Errorf("directive %q: invalid percentage %q", child.Name, s)
+			}
+			m.percent = percent
+		case "max_body":
+			var sizeStr string
+			if err := child.ParseParams(&sizeStr); err != nil {
+				return nil, err
+			}
+			size, err := parseSize(sizeStr)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			}
+			m.maxBody = size
+		case "timeout":
+			var durationStr string
+			if err := child.ParseParams(&durationStr); err != nil {
+				return nil, err
+			}
+			d, err := time.ParseDuration(durationStr)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			} else if d <= 0 {
+				return nil, fmt.Errorf("directive %q: duration must be positive", child.Name)
+			}
+			timeout = d
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+
+	m.client = &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return m, nil
+}
+
+func (m *mirror) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || rand.Float64()*100 >= m.percent {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Record the body while the next handler reads it
+		var body *mirrorBody
+		if r.Body != nil && r.Body != http.NoBody {
+			if r.ContentLength > m.maxBody {
+				mirrorMetrics.Add("skipped", 1)
+				next.ServeHTTP(w, r)
+				return
+			}
+			body = &mirrorBody{ReadCloser: r.Body, limit: m.maxBody}
+			r.Body = body
+		}
+
+		next.ServeHTTP(w, r)
+
+		var b []byte
+		if body != nil {
+			if !body.complete() {
+				// Either too large, or not read entirely by the next handler
+				mirrorMetrics.Add("skipped", 1)
+				return
+			}
+			b = body.buf.Bytes()
+		}
+
+		req, err := m.newRequest(r, b)
+		if err != nil {
+			mirrorMetrics.Add("failures", 1)
+			return
+		}
+
+		select {
+		case m.inflight <- struct{}{}:
+		default:
+			mirrorMetrics.Add("dropped", 1)
+			return
+		}
+		go func() {
+			defer func() {
+				<-m.inflight
+			}()
+			m.send(req)
+		}()
+	})
+}
+
+func (m *mirror) newRequest(r *http.Request, body []byte) (*http.Request, error) {
+	u := *r.URL
+	setTargetURL(&u, m.target)
+
+	// Not tied to the incoming request, which is done
+	req, err := http.NewRequestWithContext(context.Background(), r.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+
+	req.Host = r.Host
+	req.Header = r.Header.Clone()
+	for _, k := range hopByHopHeaders {
+		req.Header.Del(k)
+	}
+	req.Header.Del("Content-Length")
+	return req, nil
+}
+
+func (m *mirror) send(req *http.Request) {
+	mirrorMetrics.Add("requests", 1)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		mirrorMetrics.Add("failures", 1)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 500 {
+		mirrorMetrics.Add("failures", 1)
+	}
+}
+
+// mirrorBody records a request body as it's being read, up to a limit.
+type mirrorBody struct {
+	io.ReadCloser
+	limit    int64
+	buf      bytes.Buffer
+	eof      bool
+	tooLarge bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.tooLarge {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.tooLarge = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *mirrorBody) complete() bool {
+	return b.eof && !b.tooLarge
+}
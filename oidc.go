@@ -0,0 +1,843 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+const (
+	oidcSessionCookie = "kimchi_oidc_session"
+	oidcStateCookie   = "kimchi_oidc_state"
+
+	oidcDefaultCallbackPath    = "/oauth2/callback"
+	oidcDefaultLogoutPath      = "/oauth2/logout"
+	oidcDefaultSessionLifetime = 24 * time.Hour
+	oidcStateLifetime          = 10 * time.Minute
+	oidcHTTPTimeout            = 10 * time.Second
+	oidcJWKSRefreshInterval    = time.Minute
+	oidcClockSkew              = time.Minute
+)
+
+// Header fields used to forward the user's identity to the backend
+var oidcIdentityHeaders = []string{
+	"X-Forwarded-User",
+	"X-Forwarded-Email",
+	"X-Forwarded-Groups",
+	"X-Forwarded-Preferred-Username",
+}
+
+// oidcAuth implements the OpenID Connect authorization code flow with PKCE.
+type oidcAuth struct {
+	issuer          string
+	clientID        string
+	clientSecret    string
+	scopes          []string
+	sitePath        string
+	callbackPath    string
+	logoutPath      string
+	sessionLifetime time.Duration
+	groupsClaim     string
+	// Whether email addresses are trusted when the email_verified claim is
+	// missing
+	assumeEmailVerified bool
+
+	allowEmails  map[string]bool
+	allowDomains map[string]bool
+	allowGroups  map[string]bool
+
+	aead   cipher.AEAD
+	client *http.Client
+	// Identifies the site and the provider, so that cookies can't be used
+	// with another oidc directive sharing the same cookie_secret
+	cookieScope string
+
+	mu            sync.Mutex
+	provider      *oidcProviderMetadata
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcState is stored in a cookie while the user is redirected to the
+// provider.
+type oidcState struct {
+	State        string    `json:"state"`
+	Nonce        string    `json:"nonce"`
+	CodeVerifier string    `json:"code_verifier"`
+	RedirectTo   string    `json:"redirect_to"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// oidcSession is stored in a cookie once the user is logged in.
+type oidcSession struct {
+	Subject           string    `json:"sub"`
+	Email             string    `json:"email,omitempty"`
+	PreferredUsername string    `json:"preferred_username,omitempty"`
+	Groups            []string  `json:"groups,omitempty"`
+	Expiry            time.Time `json:"expiry"`
+}
+
+func parseOIDC(sc *siteConfig, dir *scfg.Directive) (*oidcAuth, error) {
+	var issuer string
+	if err := dir.ParseParams(&issuer); err != nil {
+		return nil, err
+	}
+	if u, err := url.Parse(issuer); err != nil {
+		return nil, err
+	} else if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("invalid issuer URI %q", issuer)
+	}
+
+	oa := &oidcAuth{
+		issuer:          strings.TrimSuffix(issuer, "/"),
+		scopes:          []string{"openid", "email", "profile"},
+		sitePath:        strings.TrimSuffix(sc.path, "/"),
+		callbackPath:    oidcDefaultCallbackPath,
+		logoutPath:      oidcDefaultLogoutPath,
+		sessionLifetime: oidcDefaultSessionLifetime,
+		groupsClaim:     "groups",
+		allowEmails:     make(map[string]bool),
+		allowDomains:    make(map[string]bool),
+		allowGroups:     make(map[string]bool),
+		client:          &http.Client{Timeout: oidcHTTPTimeout},
+	}
+
+	var cookieSecret string
+	for _, child := range dir.Children {
+		var err error
+		switch child.Name {
+		case "client_id":
+			err = child.ParseParams(&oa.clientID)
+		case "client_secret":
+			err = child.ParseParams(&oa.clientSecret)
+		case "cookie_secret":
+			err = child.ParseParams(&cookieSecret)
+		case "scopes":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			oa.scopes = child.Params
+		case "callback_path":
+			err = child.ParseParams(&oa.callbackPath)
+		case "logout_path":
+			err = child.ParseParams(&oa.logoutPath)
+		case "session_lifetime":
+			var s string
+			if err := child.ParseParams(&s); err != nil {
+				return nil, err
+			}
+			oa.sessionLifetime, err = time.ParseDuration(s)
+			if err == nil && oa.sessionLifetime <= 0 {
+				err = fmt.Errorf("directive %q: invalid duration %q", child.Name, s)
+			}
+		case "groups_claim":
+			err = child.ParseParams(&oa.groupsClaim)
+		case "assume_email_verified":
+			oa.assumeEmailVerified = true
+		case "allow_email", "allow_domain", "allow_group":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			m := map[string]map[string]bool{
+				"allow_email":  oa.allowEmails,
+				"allow_domain": oa.allowDomains,
+				"allow_group":  oa.allowGroups,
+			}[child.Name]
+			for _, v := range child.Params {
+				if child.Name != "allow_group" {
+					v = strings.ToLower(v)
+				}
+				m[v] = true
+			}
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if oa.clientID == "" {
+		return nil, fmt.Errorf("missing client_id")
+	}
+	oa.cookieScope = strings.Join([]string{sc.ln.Network, sc.ln.Address, sc.pattern, oa.issuer, oa.clientID}, " ")
+	if len(cookieSecret) < 32 {
+		return nil, fmt.Errorf("cookie_secret must be at least 32 characters long")
+	}
+	for _, p := range []string{oa.callbackPath, oa.logoutPath} {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("invalid path %q", p)
+		}
+	}
+
+	key := sha256.Sum256([]byte(cookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	oa.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return oa, nil
+}
+
+func (oa *oidcAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requestPath(r) {
+		case oa.callbackPath:
+			oa.handleCallback(w, r)
+			return
+		case oa.logoutPath:
+			// Only allow POST from the same origin, to prevent other sites
+			// from logging the user out
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if origin := r.Header.Get("Origin"); origin != "" {
+				if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+			}
+			oa.clearCookie(w, r, oidcSessionCookie)
+			http.Redirect(w, r, oa.sitePath+"/", http.StatusFound)
+			return
+		}
+
+		// The incoming request's header is not trusted
+		for _, k := range oidcIdentityHeaders {
+			r.Header.Del(k)
+		}
+
+		if accessGranted(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var session oidcSession
+		if err := oa.readCookie(r, oidcSessionCookie, &session); err == nil && time.Now().Before(session.Expiry) {
+			// The allowed users may have changed since the login
+			if !oa.authorized(&session) {
+				oa.clearCookie(w, r, oidcSessionCookie)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			r.Header.Set("X-Forwarded-User", session.Subject)
+			if session.Email != "" {
+				r.Header.Set("X-Forwarded-Email", session.Email)
+			}
+			if len(session.Groups) > 0 {
+				r.Header.Set("X-Forwarded-Groups", strings.Join(session.Groups, ","))
+			}
+			if session.PreferredUsername != "" {
+				r.Header.Set("X-Forwarded-Preferred-Username", session.PreferredUsername)
+			}
+			next.ServeHTTP(w, withAuthenticatedUser(r, "oidc:"+session.Subject))
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		oa.startLogin(w, r)
+	})
+}
+
+func (oa *oidcAuth) redirectURI(r *http.Request) string {
+	scheme := "http"
+	if contextTLSState(r.Context()) != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + oa.sitePath + oa.callbackPath
+}
+
+func (oa *oidcAuth) startLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := oa.providerMetadata()
+	if err != nil {
+		log.Printf("oidc: %v", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	state := oidcState{
+		State:        randomString(),
+		Nonce:        randomString(),
+		CodeVerifier: randomString(),
+		RedirectTo:   r.RequestURI,
+		Expiry:       time.Now().Add(oidcStateLifetime),
+	}
+	if err := oa.writeCookie(w, r, oidcStateCookie, &state, state.Expiry); err != nil {
+		log.Printf("oidc: failed to write state cookie: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(state.CodeVerifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oa.clientID},
+		"redirect_uri":          {oa.redirectURI(r)},
+		"scope":                 {strings.Join(oa.scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	authURL := provider.AuthorizationEndpoint
+	if strings.Contains(authURL, "?") {
+		authURL += "&" + params.Encode()
+	} else {
+		authURL += "?" + params.Encode()
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (oa *oidcAuth) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var state oidcState
+	if err := oa.readCookie(r, oidcStateCookie, &state); err != nil || time.Now().After(state.Expiry) {
+		http.Error(w, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+	oa.clearCookie(w, r, oidcStateCookie)
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		log.Printf("oidc: authorization failed: %v: %v", errCode, query.Get("error_description"))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := oa.exchangeCode(r, query.Get("code"), &state)
+	if err != nil {
+		log.Printf("oidc: %v", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	session := oidcSession{
+		Subject:           claims.Subject,
+		PreferredUsername: claims.PreferredUsername,
+		Groups:            claims.groups,
+		Expiry:            time.Now().Add(oa.sessionLifetime),
+	}
+	// Unverified email addresses can't be used for authorization
+	if claims.EmailVerified != nil && *claims.EmailVerified {
+		session.Email = claims.Email
+	} else if claims.EmailVerified == nil && oa.assumeEmailVerified {
+		session.Email = claims.Email
+	}
+	if !oa.authorized(&session) {
+		log.Printf("oidc: user %q (%q) isn't allowed", session.Subject, claims.Email)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := oa.writeCookie(w, r, oidcSessionCookie, &session, session.Expiry); err != nil {
+		log.Printf("oidc: failed to write session cookie: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	redirectTo := state.RedirectTo
+	if !strings.HasPrefix(redirectTo, "/") || strings.HasPrefix(redirectTo, "//") {
+		redirectTo = oa.sitePath + "/"
+	}
+	http.Redirect(w, r, redirectTo, http.StatusFound)
+}
+
+func (oa *oidcAuth) authorized(session *oidcSession) bool {
+	if len(oa.allowEmails) == 0 && len(oa.allowDomains) == 0 && len(oa.allowGroups) == 0 {
+		return true
+	}
+
+	if session.Email != "" {
+		email := strings.ToLower(session.Email)
+		if oa.allowEmails[email] {
+			return true
+		}
+		if _, domain, ok := strings.Cut(email, "@"); ok && oa.allowDomains[domain] {
+			return true
+		}
+	}
+	for _, group := range session.Groups {
+		if oa.allowGroups[group] {
+			return true
+		}
+	}
+	return false
+}
+
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	Expiry            int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	EmailVerified     *bool           `json:"email_verified"`
+	PreferredUsername string          `json:"preferred_username"`
+
+	groups []string
+}
+
+func (oa *oidcAuth) exchangeCode(r *http.Request, code string, state *oidcState) (*oidcClaims, error) {
+	provider, err := oa.providerMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oa.redirectURI(r)},
+		"code_verifier": {state.CodeVerifier},
+	}
+	if oa.clientSecret == "" {
+		form.Set("client_id", oa.clientID)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if oa.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(oa.clientID), url.QueryEscape(oa.clientSecret))
+	}
+
+	resp, err := oa.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("token request failed: %v: %s", resp.Status, body)
+	}
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %v", err)
+	}
+	if tokenResp.IDToken == "" {
+		return nil, fmt.Errorf("token response is missing an ID token")
+	}
+
+	payload, err := oa.verifyJWT(tokenResp.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+
+	var claims oidcClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("invalid ID token claims: %v", err)
+	}
+	if claims.Issuer != provider.Issuer {
+		return nil, fmt.Errorf("invalid ID token issuer %q", claims.Issuer)
+	}
+	if !audienceContains(claims.Audience, oa.clientID) {
+		return nil, fmt.Errorf("invalid ID token audience")
+	}
+	if time.Now().Add(-oidcClockSkew).After(time.Unix(claims.Expiry, 0)) {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(state.Nonce)) != 1 {
+		return nil, fmt.Errorf("invalid ID token nonce")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("ID token is missing a subject")
+	}
+
+	var rawClaims map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &rawClaims); err != nil {
+		return nil, err
+	}
+	if raw, ok := rawClaims[oa.groupsClaim]; ok {
+		if err := json.Unmarshal(raw, &claims.groups); err != nil {
+			var group string
+			if json.Unmarshal(raw, &group) == nil {
+				claims.groups = []string{group}
+			}
+		}
+	}
+
+	return &claims, nil
+}
+
+func audienceContains(raw json.RawMessage, clientID string) bool {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return single == clientID
+	}
+	var l []string
+	if err := json.Unmarshal(raw, &l); err != nil {
+		return false
+	}
+	for _, aud := range l {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func (oa *oidcAuth) fetchJSON(rawURL string, v interface{}) error {
+	resp, err := oa.client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v: %v", rawURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// providerMetadata discovers the provider's configuration, see OpenID
+// Connect Discovery 1.0 section 4.
+func (oa *oidcAuth) providerMetadata() (*oidcProviderMetadata, error) {
+	oa.mu.Lock()
+	cached := oa.provider
+	oa.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	// The lock isn't held while fetching, to avoid blocking other requests
+	var provider oidcProviderMetadata
+	if err := oa.fetchJSON(oa.issuer+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, fmt.Errorf("failed to discover provider: %v", err)
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != oa.issuer {
+		return nil, fmt.Errorf("provider issuer mismatch: got %q, want %q", provider.Issuer, oa.issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, fmt.Errorf("incomplete provider metadata")
+	}
+
+	oa.mu.Lock()
+	defer oa.mu.Unlock()
+	if oa.provider == nil {
+		oa.provider = &provider
+	}
+	return oa.provider, nil
+}
+
+// publicKey returns the provider's key with the specified ID. The provider's
+// key set is re-fetched if the key is unknown, to handle key rotation.
+func (oa *oidcAuth) publicKey(kid string) (crypto.PublicKey, error) {
+	provider, err := oa.providerMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	oa.mu.Lock()
+	key, ok := oa.keys[kid]
+	refresh := !ok && time.Since(oa.keysFetchedAt) >= oidcJWKSRefreshInterval
+	if refresh {
+		// Other requests don't fetch the key set again meanwhile
+		oa.keysFetchedAt = time.Now()
+	}
+	oa.mu.Unlock()
+	if ok {
+		return key, nil
+	} else if !refresh {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := oa.fetchJSON(provider.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch key set: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("oidc: ignoring key %q: %v", jwk.KeyID, err)
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+
+	oa.mu.Lock()
+	oa.keys = keys
+	oa.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.KeyType)
+	}
+}
+
+// ecdsaAlgorithms maps curves to JWS algorithms, see RFC 7518 section 3.4.
+var ecdsaAlgorithms = map[string]string{
+	"P-256": "ES256",
+	"P-384": "ES384",
+	"P-521": "ES512",
+}
+
+// verifyJWT checks a JSON Web Token's signature and returns its payload.
+func (oa *oidcAuth) verifyJWT(token string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %v", err)
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %v", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature: %v", err)
+	}
+
+	var hash crypto.Hash
+	switch header.Algorithm[len(header.Algorithm)-min(len(header.Algorithm), 3):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", header.Algorithm)
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	key, err := oa.publicKey(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case strings.HasPrefix(header.Algorithm, "RS"):
+			err = rsa.VerifyPKCS1v15(key, hash, digest, sig)
+		case strings.HasPrefix(header.Algorithm, "PS"):
+			err = rsa.VerifyPSS(key, hash, digest, sig, nil)
+		default:
+			err = fmt.Errorf("algorithm %q doesn't match RSA key", header.Algorithm)
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if header.Algorithm != ecdsaAlgorithms[key.Curve.Params().Name] {
+			err = fmt.Errorf("algorithm %q doesn't match EC key", header.Algorithm)
+		} else if len(sig) != 2*size {
+			err = fmt.Errorf("invalid ECDSA signature length")
+		} else {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				err = fmt.Errorf("ECDSA verification failure")
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported key type %T", key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT signature: %v", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %v", err)
+	}
+	return payload, nil
+}
+
+func (oa *oidcAuth) cookiePath() string {
+	return oa.sitePath + "/"
+}
+
+// writeCookie encrypts and stores a value in a cookie.
+func (oa *oidcAuth) writeCookie(w http.ResponseWriter, r *http.Request, name string, v interface{}, expiry time.Time) error {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, oa.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// Use the cookie name and scope as additional data to prevent cookies
+	// from being swapped or used on another site
+	ciphertext := oa.aead.Seal(nonce, nonce, plaintext, oa.cookieAdditionalData(name))
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    base64.RawURLEncoding.EncodeToString(ciphertext),
+		Path:     oa.cookiePath(),
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   contextTLSState(r.Context()) != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// readCookie decrypts a value stored in a cookie.
+func (oa *oidcAuth) readCookie(r *http.Request, name string, v interface{}) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return err
+	}
+	nonceSize := oa.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return errors.New("cookie too short")
+	}
+	plaintext, err := oa.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], oa.cookieAdditionalData(name))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(plaintext, v)
+}
+
+func (oa *oidcAuth) cookieAdditionalData(name string) []byte {
+	return []byte(name + "\x00" + oa.cookieScope)
+}
+
+func (oa *oidcAuth) clearCookie(w http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     oa.cookiePath(),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   contextTLSState(r.Context()) != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("failed to generate random bytes: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+const testCookieSecret = "0123456789abcdef0123456789abcdef"
+
+// mockIssuer is a minimal OpenID Connect provider, which logs in a single
+// user without asking for credentials.
+type mockIssuer struct {
+	*httptest.Server
+	key   *ecdsa.PrivateKey
+	alg   string
+	email string
+	// Value of the email_verified claim, omitted if nil
+	emailVerified interface{}
+
+	mu    sync.Mutex
+	codes map[string]url.Values // code → authorization request parameters
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := &mockIssuer{
+		key:   key,
+		alg:   "ES256",
+		email: "alice@example.org",
+		codes: make(map[string]url.Values),
+
+		emailVerified: true,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 mi.URL,
+			"authorization_endpoint": mi.URL + "/authorize",
+			"token_endpoint":         mi.URL + "/token",
+			"jwks_uri":               mi.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		pub := mi.key.PublicKey
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "EC",
+				"kid": "test",
+				"use": "sig",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		code := randomString()
+		mi.mu.Lock()
+		mi.codes[code] = query
+		mi.mu.Unlock()
+
+		redirectURI, err := url.Parse(query.Get("redirect_uri"))
+		if err != nil {
+			http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+			return
+		}
+		redirectURI.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+		http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		code := r.PostFormValue("code")
+		mi.mu.Lock()
+		authParams, ok := mi.codes[code]
+		delete(mi.codes, code)
+		mi.mu.Unlock()
+		if !ok {
+			http.Error(w, "invalid code", http.StatusBadRequest)
+			return
+		}
+
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(challenge[:]) != authParams.Get("code_challenge") {
+			http.Error(w, "invalid code verifier", http.StatusBadRequest)
+			return
+		}
+		if r.PostFormValue("redirect_uri") != authParams.Get("redirect_uri") {
+			http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+			return
+		}
+
+		claims := map[string]interface{}{
+			"iss":   mi.URL,
+			"sub":   "alice",
+			"aud":   authParams.Get("client_id"),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": authParams.Get("nonce"),
+			"email": mi.email,
+		}
+		if mi.emailVerified != nil {
+			claims["email_verified"] = mi.emailVerified
+		}
+		idToken := mi.sign(t, claims)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+	})
+
+	mi.Server = httptest.NewServer(mux)
+	t.Cleanup(mi.Close)
+	return mi
+}
+
+func (mi *mockIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": mi.alg, "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := crypto.SHA256
+	if mi.alg == "ES384" {
+		hash = crypto.SHA384
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, mi.key, h.Sum(nil))
+	if err != nil {
+		// Called from the server goroutine: t.Fatal can't be used
+		t.Error(err)
+		return ""
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newTestOIDC(t *testing.T, issuer, pattern string, children string) http.Handler {
+	cfg, err := scfg.Read(strings.NewReader("oidc " + issuer + " {\n" +
+		"client_id kimchi\n" +
+		"cookie_secret " + testCookieSecret + "\n" +
+		children + "}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &siteConfig{
+		ln:      &Listener{Network: "tcp", Address: ":80"},
+		pattern: pattern,
+		path:    "/",
+	}
+	oa, err := parseOIDC(sc, cfg[0])
+	if err != nil {
+		t.Fatalf("parseOIDC() = %v", err)
+	}
+	return oa.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-User")))
+	}))
+}
+
+func newTestRequest(method, target string, cookies []*http.Cookie) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.RequestURI = r.URL.RequestURI()
+	r = r.WithContext(context.WithValue(r.Context(), contextKeyTLSState, (*tls.ConnectionState)(nil)))
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+// authorize starts a login and goes through the issuer's authorization
+// endpoint. It returns the callback URL and the state cookie.
+func authorize(t *testing.T, h http.Handler) (string, []*http.Cookie) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest(http.MethodGet, "http://example.org/private", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("unauthenticated request: got status %v, want redirect", w.Code)
+	}
+	stateCookies := w.Result().Cookies()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback := resp.Header.Get("Location")
+	if !strings.HasPrefix(callback, "http://example.org/oauth2/callback?") {
+		t.Fatalf("unexpected redirect from issuer: %q", callback)
+	}
+	return callback, stateCookies
+}
+
+// login goes through the authorization code flow and returns the session
+// cookie.
+func login(t *testing.T, h http.Handler) *http.Cookie {
+	callback, stateCookies := authorize(t, h)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest(http.MethodGet, callback, stateCookies))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/private" {
+		t.Fatalf("callback: got status %v and location %q, want redirect to /private: %v", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcSessionCookie {
+			return cookie
+		}
+	}
+	t.Fatal("callback didn't set a session cookie")
+	return nil
+}
+
+func serveTest(h http.Handler, method, target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest(method, target, []*http.Cookie{cookie}))
+	return w
+}
+
+func TestOIDC(t *testing.T) {
+	mi := newMockIssuer(t)
+	h := newTestOIDC(t, mi.URL, "example.org/", "")
+
+	session := login(t, h)
+	w := serveTest(h, http.MethodGet, "http://example.org/private", session)
+	if w.Code != http.StatusOK || w.Body.String() != "alice" {
+		t.Errorf("authenticated request: got status %v and user %q, want 200 and %q", w.Code, w.Body, "alice")
+	}
+}
+
+func TestOIDC_sessionScope(t *testing.T) {
+	mi := newMockIssuer(t)
+	session := login(t, newTestOIDC(t, mi.URL, "example.org/", ""))
+
+	// Another site sharing the same cookie secret
+	other := newTestOIDC(t, mi.URL, "other.example.org/", "")
+	w := serveTest(other, http.MethodGet, "http://other.example.org/private", session)
+	if w.Code != http.StatusFound {
+		t.Errorf("request to other site: got status %v, want redirect to the issuer", w.Code)
+	}
+}
+
+func TestOIDC_allowlist(t *testing.T) {
+	mi := newMockIssuer(t)
+	session := login(t, newTestOIDC(t, mi.URL, "example.org/", "allow_domain example.org\n"))
+
+	// The user has been removed from the allowlist since the login
+	h := newTestOIDC(t, mi.URL, "example.org/", "allow_email bob@example.org\n")
+	w := serveTest(h, http.MethodGet, "http://example.org/private", session)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("request from disallowed user: got status %v, want 403", w.Code)
+	}
+
+	mi.email = "mallory@example.com"
+	h = newTestOIDC(t, mi.URL, "example.org/", "allow_domain example.org\n")
+	callback, stateCookies := authorize(t, h)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest(http.MethodGet, callback, stateCookies))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("callback for disallowed user: got status %v, want 403", w.Code)
+	}
+}
+
+func TestOIDC_emailVerified(t *testing.T) {
+	mi := newMockIssuer(t)
+	for _, tc := range []struct {
+		name          string
+		emailVerified interface{}
+		children      string
+		want          int
+	}{
+		{"verified", true, "", http.StatusFound},
+		{"unverified", false, "", http.StatusForbidden},
+		{"missing", nil, "", http.StatusForbidden},
+		{"missing and assumed verified", nil, "assume_email_verified\n", http.StatusFound},
+		{"unverified and assumed verified", false, "assume_email_verified\n", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mi.emailVerified = tc.emailVerified
+			h := newTestOIDC(t, mi.URL, "example.org/", "allow_domain example.org\n"+tc.children)
+			callback, stateCookies := authorize(t, h)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newTestRequest(http.MethodGet, callback, stateCookies))
+			if w.Code != tc.want {
+				t.Errorf("callback: got status %v, want %v", w.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestOIDC_logout(t *testing.T) {
+	mi := newMockIssuer(t)
+	h := newTestOIDC(t, mi.URL, "example.org/", "")
+	session := login(t, h)
+
+	w := serveTest(h, http.MethodGet, "http://example.org/oauth2/logout", session)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET logout: got status %v, want 405", w.Code)
+	}
+
+	r := newTestRequest(http.MethodPost, "http://example.org/oauth2/logout", []*http.Cookie{session})
+	r.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("cross-origin POST logout: got status %v, want 403", w.Code)
+	}
+
+	w = serveTest(h, http.MethodPost, "http://example.org/oauth2/logout", session)
+	if w.Code != http.StatusFound {
+		t.Fatalf("POST logout: got status %v, want redirect", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcSessionCookie || cookies[0].MaxAge >= 0 {
+		t.Errorf("POST logout: session cookie not cleared: %v", cookies)
+	}
+}
+
+func TestOIDC_algorithmMismatch(t *testing.T) {
+	mi := newMockIssuer(t)
+	mi.alg = "ES384" // doesn't match the P-256 key
+	h := newTestOIDC(t, mi.URL, "example.org/", "")
+
+	callback, stateCookies := authorize(t, h)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest(http.MethodGet, callback, stateCookies))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("callback with mismatched algorithm: got status %v, want 502", w.Code)
+	}
+}
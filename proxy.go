@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+// contextKeyProxyRequest holds the incoming request, which isn't available
+// when modifying the upstream response.
+const contextKeyProxyRequest contextKey = "proxyRequest"
+
+type reverseProxy struct {
+	proxy             *httputil.ReverseProxy
+	websocket         websocketConfig
+	headerUp          []headerRule
+	headerDown        []headerRule
+	preserveForwarded bool
+	upstreamHost      string
+	rewriteRedirects  bool
+	rewriteCookies    bool
+	paths             *pathRewriter
+	bodyReplacer      *strings.Replacer // nil if no replace_body directive
+}
+
+func parseReverseProxy(sc *siteConfig, dir *scfg.Directive) (http.Handler, error) {
+	var urlStr string
+	if err := dir.ParseParams(&urlStr); err != nil {
+		return nil, err
+	}
+	target, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := &reverseProxy{}
+	var transportCfg *transportConfig
+	var bodyReplacements []string
+	var retry *retryPolicy
+	var breaker *circuitBreaker
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "websocket":
+			if rp.websocket, err = parseWebSocket(child); err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			}
+		case "transport":
+			if transportCfg, err = parseTransport(child); err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			}
+		case "header_up", "header_down":
+			rule, err := parseHeaderRule(child)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			}
+			if child.Name == "header_up" {
+				rp.headerUp = append(rp.headerUp, rule)
+			} else if rule.name == "Host" {
+				return nil, fmt.Errorf("directive %q: can't change the Host header field", child.Name)
+			} else {
+				rp.headerDown = append(rp.headerDown, rule)
+			}
+		case "retry":
+			if retry, err = parseRetry(child); err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			}
+		case "circuit_breaker":
+			if breaker, err = parseCircuitBreaker(child); err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			}
+
+			k := sc.key(dir)
+			if _, ok := sc.srv.circuitBreakers[k]; ok {
+				// The state is identified by the reverse_proxy directive
+				return nil, fmt.Errorf("directive %q: the site has another identical reverse_proxy directive with a circuit breaker", child.Name)
+			}
+			sc.srv.circuitBreakers[k] = breaker
+		case "preserve_forwarded":
+			rp.preserveForwarded = true
+		case "rewrite_redirects":
+			rp.rewriteRedirects = true
+		case "rewrite_cookies":
+			rp.rewriteCookies = true
+		case "replace_body":
+			old, new, err := parseReplaceBody(child, sc.path)
+			if err != nil {
+				return nil, err
+			}
+			bodyReplacements = append(bodyReplacements, old, new)
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+
+	var transport http.RoundTripper
+	h2c := false
+	switch target.Scheme {
+	case "http", "https":
+		if target.Scheme == "http" && transportCfg != nil && transportCfg.tls != nil {
+			return nil, fmt.Errorf("directive \"transport\": TLS options can't be used with http")
+		}
+		if transportCfg != nil {
+			transport = transportCfg.newHTTPTransport()
+		}
+	case "h2c":
+		// HTTP/2 with prior knowledge, e.g. for gRPC
+		if transportCfg == nil {
+			transportCfg = &transportConfig{}
+		}
+		if transport, err = transportCfg.newH2CTransport(); err != nil {
+			return nil, fmt.Errorf("directive \"transport\": %v", err)
+		}
+		target.Scheme = "http"
+		h2c = true
+		if target.Path == "" {
+			// gRPC methods are identified by the request path
+			target.Path = "/"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported URI scheme %q", target.Scheme)
+	}
+
+	if retry != nil || breaker != nil {
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		transport = &upstreamTransport{
+			next:    transport,
+			retry:   retry,
+			breaker: breaker,
+		}
+	}
+
+	rp.upstreamHost = target.Host
+	rp.paths = newPathRewriter(target, sc.path)
+	if len(bodyReplacements) > 0 {
+		rp.bodyReplacer = strings.NewReplacer(bodyReplacements...)
+	}
+
+	rewrite := func(pr *httputil.ProxyRequest) {
+		in, req := pr.In, pr.Out
+
+		proto := "http"
+		if contextTLSState(in.Context()) != nil {
+			proto = "https"
+		}
+
+		setTargetURL(req.URL, target)
+
+		// httputil.ReverseProxy has stripped the incoming request's reverse
+		// proxy header fields: they're not trusted, unless they've been set
+		// by a trusted proxy and preserve_forwarded is enabled
+		var peer string
+		if rp.preserveForwarded {
+			peer = contextTrustedPeer(in.Context())
+		}
+		if peer != "" {
+			forwarded := fmt.Sprintf("for=%q;host=%q;proto=%q", formatForwardedNode(peer), in.Host, proto)
+			if prior := in.Header.Values("Forwarded"); len(prior) > 0 {
+				forwarded = strings.Join(prior, ", ") + ", " + forwarded
+			}
+			req.Header.Set("Forwarded", forwarded)
+
+			forwardedFor := parseRemoteAddr(peer).String()
+			if prior := in.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+				forwardedFor = strings.Join(prior, ", ") + ", " + forwardedFor
+			}
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+
+			if v := in.Header.Get("X-Forwarded-Host"); v != "" {
+				req.Header.Set("X-Forwarded-Host", v)
+			} else {
+				req.Header.Set("X-Forwarded-Host", in.Host)
+			}
+			if v := in.Header.Get("X-Forwarded-Proto"); v != "" {
+				req.Header.Set("X-Forwarded-Proto", v)
+			} else {
+				req.Header.Set("X-Forwarded-Proto", proto)
+			}
+		} else {
+			req.Header.Set("Forwarded", fmt.Sprintf("for=%q;host=%q;proto=%q", formatForwardedNode(in.RemoteAddr), in.Host, proto))
+			if ip := remoteIP(in); ip.IsValid() {
+				req.Header.Set("X-Forwarded-For", ip.String())
+			}
+			req.Header.Set("X-Forwarded-Host", in.Host)
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+
+		if rp.bodyReplacer != nil {
+			// Let the transport decompress the response body
+			req.Header.Del("Accept-Encoding")
+		}
+
+		if len(rp.headerUp) > 0 {
+			applyHeaderRules(req.Header, rp.headerUp, rp.placeholders(in), &req.Host)
+		}
+	}
+	modifyResponse := func(resp *http.Response) error {
+		markUpstreamResponse(resp.Request.Context())
+		// Only missing if the handler hasn't been called via ServeHTTP
+		in, ok := resp.Request.Context().Value(contextKeyProxyRequest).(*http.Request)
+
+		if ok && rp.rewriteRedirects {
+			if v := resp.Header.Get("Location"); v != "" {
+				resp.Header.Set("Location", rp.paths.rewriteURL(v, in.Host))
+			}
+			if v := resp.Header.Get("Refresh"); v != "" {
+				resp.Header.Set("Refresh", rp.paths.rewriteRefresh(v, in.Host))
+			}
+		}
+		if ok && rp.rewriteCookies {
+			for i, v := range resp.Header["Set-Cookie"] {
+				resp.Header["Set-Cookie"][i] = rp.paths.rewriteSetCookie(v, in.Host)
+			}
+		}
+		if rp.bodyReplacer != nil {
+			if err := replaceBody(resp, rp.bodyReplacer); err != nil {
+				return err
+			}
+		}
+
+		if ok && len(rp.headerDown) > 0 {
+			applyHeaderRules(resp.Header, rp.headerDown, rp.placeholders(in), nil)
+		}
+		return nil
+	}
+	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) {
+		var maxBytesErr *http.MaxBytesError
+		var openErr *circuitOpenError
+		if errors.As(err, &maxBytesErr) {
+			// The request body exceeds the request_body limit
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		} else if errors.As(err, &openErr) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(openErr.retryAfter.Seconds()))))
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("reverse_proxy: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	rp.proxy = &httputil.ReverseProxy{
+		Rewrite:        rewrite,
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
+		Transport:      transport,
+	}
+	if h2c {
+		// gRPC streams must not be buffered
+		rp.proxy.FlushInterval = -1
+	}
+	return rp, nil
+}
+
+// setTargetURL rewrites the URL of a request for the target URI. If the
+// target URI ends with a final slash, the request's path is appended.
+func setTargetURL(u, target *url.URL) {
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+	if strings.HasSuffix(target.Path, "/") {
+		p := path.Join("/", u.Path)
+		if strings.HasSuffix(u.Path, "/") && !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+		u.Path = strings.TrimSuffix(target.Path, "/") + p
+	} else {
+		u.Path = target.Path
+	}
+	if target.RawQuery == "" || u.RawQuery == "" {
+		u.RawQuery = target.RawQuery + u.RawQuery
+	} else {
+		u.RawQuery = target.RawQuery + "&" + u.RawQuery
+	}
+}
+
+func (rp *reverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isWebSocketUpgrade(r) {
+		if ln := contextListener(r.Context()); ln != nil {
+			w = &websocketRW{ResponseWriter: w, ln: ln, cfg: &rp.websocket}
+		}
+	}
+	r = r.WithContext(context.WithValue(r.Context(), contextKeyProxyRequest, r))
+	rp.proxy.ServeHTTP(w, r)
+}
+
+func (rp *reverseProxy) placeholders(r *http.Request) *strings.Replacer {
+	scheme := "http"
+	if contextTLSState(r.Context()) != nil {
+		scheme = "https"
+	}
+	var remoteIPStr string
+	if ip := remoteIP(r); ip.IsValid() {
+		remoteIPStr = ip.String()
+	}
+	return strings.NewReplacer(
+		"{remote_ip}", remoteIPStr,
+		"{host}", r.Host,
+		"{scheme}", scheme,
+		"{method}", r.Method,
+		"{uri}", r.RequestURI,
+		"{upstream_host}", rp.upstreamHost,
+	)
+}
+
+// headerRule describes a header_up or header_down directive.
+type headerRule struct {
+	op    string // "set", "add" or "remove"
+	name  string
+	value string // may contain placeholders
+}
+
+func parseHeaderRule(dir *scfg.Directive) (headerRule, error) {
+	var rule headerRule
+	if len(dir.Params) == 0 {
+		return rule, fmt.Errorf("expected at least one parameter")
+	}
+	rule.op = dir.Params[0]
+	switch rule.op {
+	case "set", "add":
+		if len(dir.Params) != 3 {
+			return rule, fmt.Errorf("expected 3 parameters")
+		}
+		rule.value = dir.Params[2]
+	case "remove":
+		if len(dir.Params) != 2 {
+			return rule, fmt.Errorf("expected 2 parameters")
+		}
+	default:
+		return rule, fmt.Errorf("unknown operation %q", rule.op)
+	}
+	rule.name = http.CanonicalHeaderKey(dir.Params[1])
+	if rule.name == "Host" && rule.op != "set" {
+		return rule, fmt.Errorf("the Host header field can only be set")
+	}
+	return rule, nil
+}
+
+// applyHeaderRules applies header rules to a header. If host is non-nil, the
+// Host header field is stored into it.
+func applyHeaderRules(h http.Header, rules []headerRule, repl *strings.Replacer, host *string) {
+	for _, rule := range rules {
+		value := repl.Replace(rule.value)
+		switch {
+		case rule.name == "Host" && host != nil:
+			*host = value
+		case rule.op == "set":
+			h.Set(rule.name, value)
+		case rule.op == "add":
+			h.Add(rule.name, value)
+		case rule.op == "remove":
+			h.Del(rule.name)
+		}
+	}
+}
+
+// grpcHTTPStatus maps gRPC status codes to HTTP status codes, for logging
+// purposes.
+var grpcHTTPStatus = map[string]int{
+	"0":  http.StatusOK,                  // OK
+	"1":  499,                            // CANCELLED
+	"2":  http.StatusInternalServerError, // UNKNOWN
+	"3":  http.StatusBadRequest,          // INVALID_ARGUMENT
+	"4":  http.StatusGatewayTimeout,      // DEADLINE_EXCEEDED
+	"5":  http.StatusNotFound,            // NOT_FOUND
+	"6":  http.StatusConflict,            // ALREADY_EXISTS
+	"7":  http.StatusForbidden,           // PERMISSION_DENIED
+	"8":  http.StatusTooManyRequests,     // RESOURCE_EXHAUSTED
+	"9":  http.StatusBadRequest,          // FAILED_PRECONDITION
+	"10": http.StatusConflict,            // ABORTED
+	"11": http.StatusBadRequest,          // OUT_OF_RANGE
+	"12": http.StatusNotImplemented,      // UNIMPLEMENTED
+	"13": http.StatusInternalServerError, // INTERNAL
+	"14": http.StatusServiceUnavailable,  // UNAVAILABLE
+	"15": http.StatusInternalServerError, // DATA_LOSS
+	"16": http.StatusUnauthorized,        // UNAUTHENTICATED
+}
+
+// grpcStatus returns the HTTP status code corresponding to the grpc-status
+// of a gRPC response, which is sent either in the header or in the trailer.
+// It returns the HTTP status code unchanged for other responses.
+func grpcStatus(h http.Header, status int) int {
+	if status != http.StatusOK || !strings.HasPrefix(h.Get("Content-Type"), "application/grpc") {
+		return status
+	}
+	v := h.Get("Grpc-Status")
+	if v == "" {
+		v = h.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	if mapped, ok := grpcHTTPStatus[v]; ok {
+		return mapped
+	}
+	return status
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~emersion/go-scfg"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newGRPCServer starts a gRPC server over h2c. It implements a streaming echo
+// method, which replies to each message as soon as it's received, and a
+// method which fails.
+func newGRPCServer(t *testing.T) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" || r.Header.Get("Te") != "trailers" {
+			http.Error(w, "not a gRPC request", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		switch r.URL.Path {
+		case "/test.Echo/Stream":
+			w.WriteHeader(http.StatusOK)
+			for {
+				msg, err := readGRPCMessage(r.Body)
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					w.Header().Set("Grpc-Status", "13") // INTERNAL
+					w.Header().Set("Grpc-Message", err.Error())
+					return
+				}
+				writeGRPCMessage(w, msg)
+				w.(http.Flusher).Flush()
+			}
+			w.Header().Set("Grpc-Status", "0")
+		case "/test.Echo/Fail":
+			w.WriteHeader(http.StatusOK)
+			w.Header().Set("Grpc-Status", "7") // PERMISSION_DENIED
+			w.Header().Set("Grpc-Message", "nope")
+		default:
+			w.Header().Set("Grpc-Status", "12") // UNIMPLEMENTED
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	ts := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	var prefix [5]byte // uncompressed
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// newTestGRPCProxy starts a TLS server proxying requests to a gRPC server,
+// and returns a client speaking HTTP/2 to it.
+func newTestGRPCProxy(t *testing.T, upstream string) (*httptest.Server, *http.Client) {
+	cfg, err := scfg.Read(strings.NewReader("reverse_proxy h2c://" + upstream + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := parseReverseProxy(&siteConfig{path: "/"}, cfg[0])
+	if err != nil {
+		t.Fatalf("parseReverseProxy() = %v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), contextKeyTLSState, r.TLS))
+		rp.ServeHTTP(w, r)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts, ts.Client()
+}
+
+func newGRPCRequest(t *testing.T, url string, body io.Reader) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	return req
+}
+
+func TestReverseProxy_gRPCStream(t *testing.T) {
+	upstream := newGRPCServer(t)
+	ts, client := newTestGRPCProxy(t, strings.TrimPrefix(upstream.URL, "http://"))
+
+	// The response header is only sent by the server along with the first
+	// reply, so the first message needs to be written before the response
+	// is available
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	var resp *http.Response
+	var err error
+	go func() {
+		resp, err = client.Do(newGRPCRequest(t, ts.URL+"/test.Echo/Stream", pr))
+		close(done)
+	}()
+
+	if err := writeGRPCMessage(pw, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("got protocol %v, want HTTP/2", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v, want 200", resp.StatusCode)
+	}
+
+	// Each reply must be received before the next message is sent: this
+	// fails if either direction is buffered
+	br := bufio.NewReader(resp.Body)
+	for i, want := range []string{"hello", "world"} {
+		if i > 0 {
+			if err := writeGRPCMessage(pw, []byte(want)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg, err := readGRPCMessage(br)
+		if err != nil {
+			t.Fatalf("reading reply: %v", err)
+		}
+		if string(msg) != want {
+			t.Errorf("got reply %q, want %q", msg, want)
+		}
+	}
+	pw.Close()
+
+	if _, err := readGRPCMessage(br); err != io.EOF {
+		t.Fatalf("got %v after the last reply, want EOF", err)
+	}
+	if v := resp.Trailer.Get("Grpc-Status"); v != "0" {
+		t.Errorf("got grpc-status %q, want %q", v, "0")
+	}
+}
+
+func TestReverseProxy_gRPCStatus(t *testing.T) {
+	upstream := newGRPCServer(t)
+	ts, client := newTestGRPCProxy(t, strings.TrimPrefix(upstream.URL, "http://"))
+
+	for _, tc := range []struct {
+		path, status string
+		httpStatus   int
+	}{
+		{"/test.Echo/Fail", "7", http.StatusForbidden},
+		{"/test.Echo/Unknown", "12", http.StatusNotImplemented},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			resp, err := client.Do(newGRPCRequest(t, ts.URL+tc.path, http.NoBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			// The status is sent in the trailer, or in the header for
+			// trailers-only responses
+			h := resp.Header.Clone()
+			for k, v := range resp.Trailer {
+				h[http.TrailerPrefix+k] = v
+			}
+			v := h.Get("Grpc-Status")
+			if v == "" {
+				v = h.Get(http.TrailerPrefix + "Grpc-Status")
+			}
+			if v != tc.status {
+				t.Errorf("got grpc-status %q, want %q", v, tc.status)
+			}
+			if got := grpcStatus(h, resp.StatusCode); got != tc.httpStatus {
+				t.Errorf("grpcStatus() = %v, want %v", got, tc.httpStatus)
+			}
+		})
+	}
+}
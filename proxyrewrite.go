@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+// maxReplaceBodySize is the maximum size of response bodies buffered to
+// apply replace_body rules. Larger bodies are sent unchanged.
+const maxReplaceBodySize = 16 << 20
+
+// pathRewriter maps upstream URLs to URLs reachable by clients, when the
+// upstream is mounted under a site path.
+type pathRewriter struct {
+	target       *url.URL
+	upstreamBase string // upstream path prefix, without final slash
+	sitePrefix   string // site path, without final slash
+}
+
+func newPathRewriter(target *url.URL, sitePath string) *pathRewriter {
+	base := target.Path
+	if i := strings.LastIndex(base, "/"); i >= 0 {
+		base = base[:i]
+	}
+	return &pathRewriter{
+		target:       target,
+		upstreamBase: base,
+		sitePrefix:   strings.TrimSuffix(sitePath, "/"),
+	}
+}
+
+// rewritePath maps an absolute upstream path to a site path. ok is false if
+// the path isn't under the upstream base path.
+func (pr *pathRewriter) rewritePath(p string) (string, bool) {
+	rest, ok := strings.CutPrefix(p, pr.upstreamBase)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return p, false
+	}
+	p = pr.sitePrefix + rest
+	if p == "" {
+		p = "/"
+	}
+	return p, true
+}
+
+// rewriteURL maps an URL referring to the upstream server to an URL
+// referring to the site. host is the host requested by the client. Other URLs
+// are returned unchanged.
+func (pr *pathRewriter) rewriteURL(s, host string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Opaque != "" {
+		return s
+	}
+	if u.Host != "" {
+		switch {
+		case u.Host == pr.target.Host && (u.Scheme == "" || u.Scheme == pr.target.Scheme):
+			// Make the URL relative to the client's host
+			u.Scheme = ""
+			u.Host = ""
+			u.User = nil
+		case strings.EqualFold(u.Host, host) && (u.Scheme == "" || u.Scheme == "http" || u.Scheme == "https"):
+			// The upstream server has built the URL from the Host header
+			// field, which is passed through. Keep the scheme, e.g. for
+			// redirects to HTTPS.
+		default:
+			return s
+		}
+	} else if u.Scheme != "" || !strings.HasPrefix(u.Path, "/") {
+		// Relative paths are resolved by the client
+		return s
+	}
+
+	p, ok := pr.rewritePath(u.Path)
+	if !ok {
+		return s
+	}
+	u.Path = p
+	u.RawPath = ""
+	return u.String()
+}
+
+// rewriteRefresh rewrites the URL of a Refresh header field value, e.g.
+// "5; url=/foo".
+func (pr *pathRewriter) rewriteRefresh(v, host string) string {
+	delay, rest, ok := strings.Cut(v, ";")
+	if !ok {
+		delay, rest, ok = strings.Cut(v, ",")
+		if !ok {
+			return v
+		}
+	}
+	rest = strings.TrimSpace(rest)
+	if len(rest) < 4 || !strings.EqualFold(rest[:4], "url=") {
+		return v
+	}
+	u := strings.TrimSpace(rest[4:])
+	quote := ""
+	if len(u) >= 2 && (u[0] == '"' || u[0] == '\'') && u[len(u)-1] == u[0] {
+		quote = u[:1]
+		u = u[1 : len(u)-1]
+	}
+	return delay + "; url=" + quote + pr.rewriteURL(u, host) + quote
+}
+
+// rewriteSetCookie rewrites the Domain and Path attributes of a Set-Cookie
+// header field value. The Domain attribute is replaced with host if it
+// matches the upstream server's host name.
+func (pr *pathRewriter) rewriteSetCookie(v, host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	upstreamHost := pr.target.Hostname()
+
+	attrs := strings.Split(v, ";")
+	for i, attr := range attrs[1:] {
+		k, val, _ := strings.Cut(attr, "=")
+		k = strings.TrimSpace(k)
+		val = strings.TrimSpace(val)
+		switch strings.ToLower(k) {
+		case "domain":
+			if strings.EqualFold(strings.TrimPrefix(val, "."), upstreamHost) {
+				attrs[i+1] = " " + k + "=" + host
+			}
+		case "path":
+			if p, ok := pr.rewritePath(val); ok {
+				attrs[i+1] = " " + k + "=" + p
+			}
+		}
+	}
+	return strings.Join(attrs, ";")
+}
+
+// parseReplaceBody parses a replace_body directive. The {prefix} placeholder
+// is replaced with the site path, without final slash.
+func parseReplaceBody(dir *scfg.Directive, sitePath string) (old, new string, err error) {
+	if err := dir.ParseParams(&old, &new); err != nil {
+		return "", "", err
+	}
+	if old == "" {
+		return "", "", fmt.Errorf("directive %q: empty search string", dir.Name)
+	}
+	prefix := strings.TrimSuffix(sitePath, "/")
+	old = strings.ReplaceAll(old, "{prefix}", prefix)
+	new = strings.ReplaceAll(new, "{prefix}", prefix)
+	return old, new, nil
+}
+
+// replaceBody applies string replacements to an HTML response body.
+func replaceBody(resp *http.Response, repl *strings.Replacer) error {
+	// Other responses have either no body or a partial body, whose
+	// Content-Length and Content-Range can't be adjusted
+	if resp.StatusCode != http.StatusOK || resp.Request.Method == http.MethodHead {
+		return nil
+	}
+	if !matchMediaType([]string{"text/html"}, resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxReplaceBodySize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxReplaceBodySize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	b = []byte(repl.Replace(string(b)))
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	// The upstream's validators don't match the modified body
+	resp.Header.Del("ETag")
+	resp.Header.Del("Content-MD5")
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+// rateLimitSweepInterval is the minimum delay between two removals of idle
+// buckets.
+const rateLimitSweepInterval = time.Minute
+
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	key   func(r *http.Request) string
+	paths []string
+	// Whether requests are grouped by authenticated user
+	keyUser bool
+
+	store atomic.Pointer[rateLimitStore]
+}
+
+type rateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func parseRateLimit(dir *scfg.Directive) (*rateLimiter, error) {
+	var rateStr string
+	if err := dir.ParseParams(&rateStr); err != nil {
+		return nil, err
+	}
+	rate, err := parseRate(rateStr)
+	if err != nil {
+		return nil, err
+	}
+
+	rl := &rateLimiter{
+		rate:  rate,
+		burst: math.Max(1, math.Ceil(rate)),
+		key:   remoteIPKey,
+	}
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "burst":
+			var burstStr string
+			if err := child.ParseParams(&burstStr); err != nil {
+				return nil, err
+			}
+			burst, err := strconv.Atoi(burstStr)
+			if err != nil || burst <= 0 {
+				return nil, fmt.Errorf("invalid burst %q", burstStr)
+			}
+			rl.burst = float64(burst)
+		case "key":
+			var kind string
+			if err := child.ParseParams(&kind); err != nil {
+				return nil, err
+			}
+			switch kind {
+			case "ip":
+				rl.key = remoteIPKey
+			case "user":
+				rl.keyUser = true
+				rl.key = func(r *http.Request) string {
+					if user := authenticatedUser(r.Context()); user != "" {
+						return "user:" + user
+					}
+					return remoteIPKey(r)
+				}
+			case "header":
+				var name string
+				if err := child.ParseParams(nil, &name); err != nil {
+					return nil, err
+				}
+				rl.key = func(r *http.Request) string {
+					if v := r.Header.Get(name); v != "" {
+						return "header:" + v
+					}
+					return remoteIPKey(r)
+				}
+			default:
+				return nil, fmt.Errorf("unknown key %q", kind)
+			}
+		case "path":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			rl.paths = append(rl.paths, child.Params...)
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+
+	rl.store.Store(&rateLimitStore{buckets: make(map[string]*tokenBucket)})
+	return rl, nil
+}
+
+// parseRate parses a rate such as "10/s", "100/m" or "5/10s", and returns it
+// in events per second.
+func parseRate(s string) (float64, error) {
+	countStr, periodStr, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q: expected <count>/<period>", s)
+	}
+	count, err := strconv.ParseFloat(countStr, 64)
+	if err != nil || count <= 0 {
+		return 0, fmt.Errorf("invalid rate %q: invalid count", s)
+	}
+
+	var period time.Duration
+	switch periodStr {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		period, err = time.ParseDuration(periodStr)
+		if err != nil || period <= 0 {
+			return 0, fmt.Errorf("invalid rate %q: invalid period", s)
+		}
+	}
+
+	return count / period.Seconds(), nil
+}
+
+func remoteIPKey(r *http.Request) string {
+	ip := remoteIP(r)
+	if !ip.IsValid() {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + ip.String()
+}
+
+// takeOver makes the rate limiter share the state of an older one.
+func (rl *rateLimiter) takeOver(old *rateLimiter) {
+	rl.store.Store(old.store.Load())
+}
+
+// reserve consumes a token for the specified key. If the limit has been
+// exceeded, it returns false and the delay after which a token will be
+// available.
+func (rl *rateLimiter) reserve(key string, now time.Time) (bool, time.Duration) {
+	store := rl.store.Load()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if now.Sub(store.lastSweep) >= rateLimitSweepInterval {
+		// Buckets which would have been refilled completely are equivalent
+		// to missing ones
+		for k, b := range store.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+				delete(store.buckets, k)
+			}
+		}
+		store.lastSweep = now
+	}
+
+	b, ok := store.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		store.buckets[key] = b
+	}
+
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / rl.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(rl.paths) > 0 && !matchPath(rl.paths, requestPath(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ok, wait := rl.reserve(rl.key(r), time.Now()); !ok {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+// requestBodyMemoryLimit is the maximum size of request bodies buffered in
+// memory. Larger bodies are spooled to disk.
+const requestBodyMemoryLimit = 64 << 10
+
+type requestBodyConfig struct {
+	maxSize int64 // 0 if unlimited
+	buffer  bool
+}
+
+func parseRequestBody(dir *scfg.Directive) (*requestBodyConfig, error) {
+	cfg := &requestBodyConfig{}
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "max_size":
+			var sizeStr string
+			if err := child.ParseParams(&sizeStr); err != nil {
+				return nil, err
+			}
+			size, err := parseSize(sizeStr)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			} else if size <= 0 {
+				return nil, fmt.Errorf("directive %q: size must be positive", child.Name)
+			}
+			cfg.maxSize = size
+		case "buffer":
+			var v string
+			if err := child.ParseParams(&v); err != nil {
+				return nil, err
+			}
+			switch v {
+			case "on":
+				cfg.buffer = true
+			case "off":
+				cfg.buffer = false
+			default:
+				return nil, fmt.Errorf("directive %q: expected \"on\" or \"off\"", child.Name)
+			}
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+	if cfg.buffer && cfg.maxSize == 0 {
+		// Otherwise any client could fill the disk
+		return nil, fmt.Errorf("directive \"buffer\" requires a \"max_size\" directive")
+	}
+	return cfg, nil
+}
+
+func (cfg *requestBodyConfig) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Always set when buffering
+		if cfg.maxSize > 0 {
+			if r.ContentLength > cfg.maxSize {
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, cfg.maxSize)
+		}
+
+		if !cfg.buffer || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := spoolRequestBody(r.Body)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			} else {
+				// Most likely the client went away
+				log.Printf("request_body: failed to buffer request body: %v", err)
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+			}
+			return
+		}
+		defer body.Close()
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Body = body.reader()
+		r2.GetBody = func() (io.ReadCloser, error) {
+			return body.reader(), nil
+		}
+		r2.ContentLength = body.size
+		r2.TransferEncoding = nil
+		r2.Header = r.Header.Clone()
+		r2.Header.Set("Content-Length", strconv.FormatInt(body.size, 10))
+		r2.Header.Del("Transfer-Encoding")
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// spooledBody is a request body buffered in memory or in a temporary file.
+type spooledBody struct {
+	buf  []byte
+	file *os.File
+	size int64
+}
+
+func spoolRequestBody(r io.Reader) (*spooledBody, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, requestBodyMemoryLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= requestBodyMemoryLimit {
+		return &spooledBody{buf: buf.Bytes(), size: n}, nil
+	}
+
+	f, err := os.CreateTemp("", "kimchi-body-")
+	if err != nil {
+		return nil, err
+	}
+	// The file is only accessed via the open file descriptor
+	os.Remove(f.Name())
+
+	size, err := io.Copy(f, io.MultiReader(&buf, r))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &spooledBody{file: f, size: size}, nil
+}
+
+// reader returns a new reader for the body. Readers don't need to be closed.
+func (b *spooledBody) reader() io.ReadCloser {
+	if b.file == nil {
+		return io.NopCloser(bytes.NewReader(b.buf))
+	}
+	return io.NopCloser(io.NewSectionReader(b.file, 0, b.size))
+}
+
+func (b *spooledBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	return b.file.Close()
+}
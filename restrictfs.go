@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+// defaultHidePatterns are the file name patterns hidden by file_server by
+// default.
+var defaultHidePatterns = []string{".*"}
+
+// hideExempt lists the file names which are never hidden. The .well-known
+// directory is used by ACME and other protocols (RFC 8615).
+var hideExempt = map[string]bool{
+	".well-known": true,
+}
+
+type symlinkPolicy int
+
+const (
+	symlinkRoot   symlinkPolicy = iota // only follow symlinks within the root
+	symlinkFollow                      // follow all symlinks
+	symlinkDeny                        // don't follow any symlink
+)
+
+// parseHide parses a hide directive. Without parameters, no file is hidden.
+func parseHide(dir *scfg.Directive) ([]string, error) {
+	for _, pattern := range dir.Params {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("directive %q: invalid pattern %q: %v", dir.Name, pattern, err)
+		}
+	}
+	return append([]string{}, dir.Params...), nil
+}
+
+// parseSymlinks parses a symlinks directive.
+func parseSymlinks(dir *scfg.Directive) (symlinkPolicy, error) {
+	var s string
+	if err := dir.ParseParams(&s); err != nil {
+		return 0, err
+	}
+	policy, err := parseSymlinkPolicy(s)
+	if err != nil {
+		return 0, fmt.Errorf("directive %q: %v", dir.Name, err)
+	}
+	return policy, nil
+}
+
+func parseSymlinkPolicy(s string) (symlinkPolicy, error) {
+	switch s {
+	case "root":
+		return symlinkRoot, nil
+	case "follow":
+		return symlinkFollow, nil
+	case "deny":
+		return symlinkDeny, nil
+	default:
+		return 0, fmt.Errorf("unknown symlink policy %q", s)
+	}
+}
+
+// restrictedFileSystem is a directory on disk which doesn't expose hidden
+// files and files outside of the directory reachable via symlinks. Such files
+// are reported as not existing.
+type restrictedFileSystem struct {
+	root     string // absolute, without symlinks
+	dir      http.Dir
+	hide     []string
+	symlinks symlinkPolicy
+}
+
+func newRestrictedFileSystem(dirname string, hide []string, symlinks symlinkPolicy) (*restrictedFileSystem, error) {
+	root, err := filepath.Abs(dirname)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+	return &restrictedFileSystem{
+		root:     root,
+		dir:      http.Dir(root),
+		hide:     hide,
+		symlinks: symlinks,
+	}, nil
+}
+
+func (fs *restrictedFileSystem) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	if !fs.allowed(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	f, err := fs.dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &restrictedFile{File: f, fs: fs, name: name}, nil
+}
+
+// allowed checks whether a file can be accessed. name must be clean and
+// absolute.
+func (fs *restrictedFileSystem) allowed(name string) bool {
+	if name == "/" {
+		return true
+	}
+	for _, elem := range strings.Split(name[1:], "/") {
+		if fs.hidden(elem) {
+			return false
+		}
+	}
+
+	filename := filepath.Join(fs.root, filepath.FromSlash(name))
+	switch fs.symlinks {
+	case symlinkFollow:
+		return true
+	case symlinkDeny:
+		for p := filename; p != fs.root; p = filepath.Dir(p) {
+			fi, err := os.Lstat(p)
+			if err != nil {
+				// Missing files are handled by the caller, but their parent
+				// directories still need to be checked
+				continue
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				return false
+			}
+		}
+		return true
+	case symlinkRoot:
+		resolved, err := filepath.EvalSymlinks(filename)
+		if err != nil {
+			// Either the file doesn't exist, or it's a dangling symlink
+			if _, err := os.Lstat(filename); err == nil {
+				return false
+			}
+			// The file may be created: check where its parent directory is
+			return fs.allowed(path.Dir(name))
+		}
+		return resolved == fs.root || strings.HasPrefix(resolved, fs.root+string(filepath.Separator))
+	default:
+		panic("unreachable")
+	}
+}
+
+func (fs *restrictedFileSystem) hidden(name string) bool {
+	if hideExempt[name] {
+		return false
+	}
+	for _, pattern := range fs.hide {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictedFile omits inaccessible files from directory listings.
+type restrictedFile struct {
+	http.File
+	fs   *restrictedFileSystem
+	name string
+}
+
+func (f *restrictedFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	return f.fs.filterDir(f.name, infos), err
+}
+
+// filterDir removes inaccessible files from the entries of a directory.
+func (fs *restrictedFileSystem) filterDir(dir string, infos []os.FileInfo) []os.FileInfo {
+	filtered := infos[:0]
+	for _, fi := range infos {
+		name := path.Join(dir, fi.Name())
+		if !fs.allowed(name) {
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			// Describe the symlink's target instead
+			target, err := os.Stat(filepath.Join(fs.root, filepath.FromSlash(name)))
+			if err != nil {
+				continue
+			}
+			fi = renamedFileInfo{target, fi.Name()}
+		}
+		filtered = append(filtered, fi)
+	}
+	return filtered
+}
+
+type renamedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi renamedFileInfo) Name() string {
+	return fi.name
+}
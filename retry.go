@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+// retryDrainLimit is the maximum number of bytes read from the body of a
+// response which is going to be retried, to allow the connection to be
+// reused.
+const retryDrainLimit = 4 << 10
+
+type retryPolicy struct {
+	count      int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	statuses   map[int]bool
+	methods    map[string]bool
+}
+
+func parseRetry(dir *scfg.Directive) (*retryPolicy, error) {
+	rp := &retryPolicy{
+		count:      2,
+		backoff:    100 * time.Millisecond,
+		maxBackoff: time.Second,
+		statuses: map[int]bool{
+			http.StatusBadGateway:         true,
+			http.StatusServiceUnavailable: true,
+			http.StatusGatewayTimeout:     true,
+		},
+		methods: map[string]bool{
+			http.MethodGet:     true,
+			http.MethodHead:    true,
+			http.MethodOptions: true,
+		},
+	}
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "count":
+			var s string
+			if err := child.ParseParams(&s); err != nil {
+				return nil, err
+			}
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("directive %q: invalid number %q", child.Name, s)
+			}
+			rp.count = n
+		case "backoff":
+			if len(child.Params) == 0 || len(child.Params) > 2 {
+				return nil, fmt.Errorf("directive %q: expected one or two parameters", child.Name)
+			}
+			var durations []time.Duration
+			for _, s := range child.Params {
+				d, err := time.ParseDuration(s)
+				if err != nil {
+					return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+				} else if d < 0 {
+					return nil, fmt.Errorf("directive %q: duration must not be negative", child.Name)
+				}
+				durations = append(durations, d)
+			}
+			rp.backoff = durations[0]
+			rp.maxBackoff = durations[0]
+			if len(durations) > 1 {
+				rp.maxBackoff = durations[1]
+			}
+			if rp.maxBackoff < rp.backoff {
+				return nil, fmt.Errorf("directive %q: maximum backoff is smaller than initial backoff", child.Name)
+			}
+		case "status":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			rp.statuses = make(map[int]bool)
+			for _, s := range child.Params {
+				status, err := strconv.Atoi(s)
+				if err != nil || status < 100 || status > 999 {
+					return nil, fmt.Errorf("directive %q: invalid status code %q", child.Name, s)
+				}
+				rp.statuses[status] = true
+			}
+		case "methods":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			rp.methods = make(map[string]bool)
+			for _, method := range child.Params {
+				rp.methods[method] = true
+			}
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+	return rp, nil
+}
+
+// delay returns the backoff before the specified retry, starting from 1.
+func (rp *retryPolicy) delay(attempt int) time.Duration {
+	d := rp.backoff
+	for i := 1; i < attempt && d < rp.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.maxBackoff {
+		d = rp.maxBackoff
+	}
+	return d
+}
+
+// upstreamTransport sends requests to an upstream server, retrying failed
+// requests and tracking failures with a circuit breaker.
+type upstreamTransport struct {
+	next    http.RoundTripper
+	retry   *retryPolicy    // may be nil
+	breaker *circuitBreaker // may be nil
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := t.retry != nil && t.retry.methods[req.Method]
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// The body can't be sent again
+		retryable = false
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(t.retry.delay(attempt))
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return nil, req.Context().Err()
+			}
+
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req = req.Clone(req.Context())
+				req.Body = body
+			}
+		}
+
+		resp, err := t.roundTrip(req)
+		last := !retryable || attempt >= t.retry.count
+		var openErr *circuitOpenError
+		if last || errors.As(err, &openErr) || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		if err == nil {
+			if !t.retry.statuses[resp.StatusCode] {
+				return resp, nil
+			}
+			io.CopyN(io.Discard, resp.Body, retryDrainLimit)
+			resp.Body.Close()
+		}
+	}
+}
+
+func (t *upstreamTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.breaker == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	tok, err := t.breaker.allow(start)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil && req.Context().Err() != nil {
+		// Requests canceled by the client aren't the upstream's fault
+		t.breaker.release(tok)
+		return resp, err
+	}
+	now := time.Now()
+	failed := err != nil || resp.StatusCode >= 500
+	t.breaker.done(tok, now, failed, now.Sub(start))
+	return resp, err
+}
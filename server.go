@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -8,6 +9,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -23,8 +25,10 @@ import (
 type contextKey string
 
 const (
-	contextKeyProtocol contextKey = "protocol"
-	contextKeyTLSState contextKey = "tlsState"
+	contextKeyProtocol   contextKey = "protocol"
+	contextKeyTLSState   contextKey = "tlsState"
+	contextKeyClientCert contextKey = "clientCert"
+	contextKeyListener   contextKey = "listener"
 )
 
 const (
@@ -42,19 +46,39 @@ func contextTLSState(ctx context.Context) *tls.ConnectionState {
 	return ctx.Value(contextKeyTLSState).(*tls.ConnectionState)
 }
 
+func contextClientCert(ctx context.Context) *clientCertState {
+	return ctx.Value(contextKeyClientCert).(*clientCertState)
+}
+
+func contextListener(ctx context.Context) *Listener {
+	ln, _ := ctx.Value(contextKeyListener).(*Listener)
+	return ln
+}
+
 type listenerKey struct {
 	network string
 	address string
 }
 
 type Server struct {
-	accessLogs *os.File
-	listeners  map[listenerKey]*Listener
+	accessLogs      *os.File
+	trustedProxies  []netip.Prefix
+	clientIPHeader  string // empty if unset
+	clientAuth      bool   // whether a site has a client_auth directive
+	listeners       map[listenerKey]*Listener
+	rateLimiters    map[string]*rateLimiter
+	webdavLocks     map[string]*webdavLockSystem
+	caches          map[string]*httpCache
+	circuitBreakers map[string]*circuitBreaker
 }
 
 func NewServer() *Server {
 	return &Server{
-		listeners: make(map[listenerKey]*Listener),
+		listeners:       make(map[listenerKey]*Listener),
+		rateLimiters:    make(map[string]*rateLimiter),
+		webdavLocks:     make(map[string]*webdavLockSystem),
+		caches:          make(map[string]*httpCache),
+		circuitBreakers: make(map[string]*circuitBreaker),
 	}
 }
 
@@ -81,6 +105,34 @@ func (srv *Server) Stop() {
 }
 
 func (srv *Server) Replace(old *Server) error {
+	// Keep the state of rate limiters whose configuration hasn't changed
+	for k, rl := range srv.rateLimiters {
+		if oldRL, ok := old.rateLimiters[k]; ok {
+			rl.takeOver(oldRL)
+		}
+	}
+
+	// Keep the stored responses of caches whose configuration hasn't changed
+	for k, c := range srv.caches {
+		if oldC, ok := old.caches[k]; ok {
+			c.takeOver(oldC)
+		}
+	}
+
+	// Keep the state of circuit breakers
+	for k, cb := range srv.circuitBreakers {
+		if oldCB, ok := old.circuitBreakers[k]; ok {
+			cb.takeOver(oldCB)
+		}
+	}
+
+	// Keep WebDAV locks
+	for k, ls := range srv.webdavLocks {
+		if oldLS, ok := old.webdavLocks[k]; ok {
+			ls.LockSystem = oldLS.LockSystem
+		}
+	}
+
 	// Start new listeners
 	for k, ln := range srv.listeners {
 		if _, ok := old.listeners[k]; ok {
@@ -126,9 +178,15 @@ type Listener struct {
 	Address string
 	mux     atomic.Value // *http.ServeMux
 
+	trustedProxies atomic.Value // []netip.Prefix
+	clientIPHeader atomic.Value // string
+
 	net           net.Listener
 	connWaitGroup sync.WaitGroup
 
+	websocketsMu sync.Mutex
+	websockets   map[*websocketConn]struct{} // nil once stopped
+
 	h1Server   *http.Server
 	h1Listener *pipeListener
 
@@ -137,14 +195,14 @@ type Listener struct {
 
 func newListener(network, addr string) *Listener {
 	ln := &Listener{
-		Network: network,
-		Address: addr,
+		Network:    network,
+		Address:    addr,
+		websockets: make(map[*websocketConn]struct{}),
 	}
 
 	chiRouter := chi.NewRouter()
-	chiRouter.Use(middleware.RealIP)
+	chiRouter.Use(ln.realIP)
 	chiRouter.Use(middleware.Heartbeat("/ping"))
-	chiRouter.Use(middleware.Compress(5))
 
 	chiRouter.Use(middleware.SetHeader("Content-Security-Policy", "default-src 'none'; img-src 'self'; style-src 'self'; script-src 'self'"))
 	chiRouter.Use(middleware.SetHeader("Cross-Origin-Embedder-Policy", "require-corp"))
@@ -186,6 +244,8 @@ func newListener(network, addr string) *Listener {
 		panic(fmt.Errorf("http2.ConfigureServer: %v", err))
 	}
 	ln.mux.Store(http.NewServeMux())
+	ln.trustedProxies.Store([]netip.Prefix(nil))
+	ln.clientIPHeader.Store(defaultClientIPHeader)
 	return ln
 }
 
@@ -226,12 +286,94 @@ func (ln *Listener) Stop() {
 		log.Printf("failed to shutdown HTTP/1 server: %v", err)
 	}
 
-	// TODO: gracefully shutdown hijacked connections (e.g. WebSocket)
+	ln.closeWebSockets()
+
 	// TODO: wait for HTTP/2 connections to be closed
 }
 
+func (ln *Listener) addWebSocket(wc *websocketConn) bool {
+	ln.websocketsMu.Lock()
+	defer ln.websocketsMu.Unlock()
+	if ln.websockets == nil {
+		return false
+	}
+	ln.websockets[wc] = struct{}{}
+	return true
+}
+
+func (ln *Listener) removeWebSocket(wc *websocketConn) {
+	ln.websocketsMu.Lock()
+	defer ln.websocketsMu.Unlock()
+	delete(ln.websockets, wc)
+}
+
+// closeWebSockets gracefully closes WebSocket connections, and waits for
+// them to be closed.
+func (ln *Listener) closeWebSockets() {
+	ln.websocketsMu.Lock()
+	websockets := ln.websockets
+	ln.websockets = nil
+	ln.websocketsMu.Unlock()
+
+	if len(websockets) == 0 {
+		return
+	}
+	log.Printf("listener %q: closing %v WebSocket connections", ln.Address, len(websockets))
+
+	var wg sync.WaitGroup
+	for wc := range websockets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wc.shutdown()
+		}()
+	}
+	wg.Wait()
+}
+
+func (ln *Listener) TrustedProxies() []netip.Prefix {
+	return ln.trustedProxies.Load().([]netip.Prefix)
+}
+
+// ClientIPHeader returns the header field used to determine the client IP
+// address of requests received from trusted proxies.
+func (ln *Listener) ClientIPHeader() string {
+	return ln.clientIPHeader.Load().(string)
+}
+
+func (ln *Listener) SetTrustedProxies(trusted []netip.Prefix, header string) {
+	ln.trustedProxies.Store(trusted)
+	ln.clientIPHeader.Store(header)
+}
+
 func (ln *Listener) UpdateFrom(new *Listener) {
 	ln.mux.Store(new.Mux())
+	ln.trustedProxies.Store(new.TrustedProxies())
+	ln.clientIPHeader.Store(new.ClientIPHeader())
+}
+
+// proxyPolicy returns the PROXY protocol policy for a connection. Headers
+// sent by other peers than trusted proxies are rejected.
+func (ln *Listener) proxyPolicy(remoteAddr net.Addr) proxyproto.Policy {
+	if peer := parseRemoteAddr(remoteAddr.String()); peer.IsValid() && isTrustedProxy(ln.TrustedProxies(), peer) {
+		return proxyproto.USE
+	}
+	return proxyproto.REJECT
+}
+
+// realIP is a middleware which sets the request's remote address to the
+// client IP address, taking trusted proxies into account.
+func (ln *Listener) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trusted := ln.TrustedProxies()
+		if peer := remoteIP(r); peer.IsValid() && isTrustedProxy(trusted, peer) {
+			r = r.WithContext(context.WithValue(r.Context(), contextKeyTrustedPeer, r.RemoteAddr))
+		}
+		if ip := resolveClientIP(r, trusted, ln.ClientIPHeader()); ip.IsValid() && ip != remoteIP(r) {
+			r.RemoteAddr = ip.String()
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (ln *Listener) serve() error {
@@ -268,11 +410,13 @@ func (ln *Listener) serve() error {
 func (ln *Listener) serveConn(conn net.Conn) error {
 	var proto string
 	var tlsState *tls.ConnectionState
+	var clientCert *clientCertState
 	remoteAddr := conn.RemoteAddr()
 	// TODO: read proto and TLS state from conn, if it's a TLS connection
 
-	// TODO: only accept PROXY protocol from trusted sources
-	proxyConn := proxyproto.NewConn(conn)
+	// Only accept the PROXY protocol from trusted sources: the header carries
+	// the client address and TLS state
+	proxyConn := proxyproto.NewConn(conn, proxyproto.WithPolicy(ln.proxyPolicy(remoteAddr)))
 	if proxyHeader := proxyConn.ProxyHeader(); proxyHeader != nil {
 		if proxyHeader.SourceAddr != nil {
 			remoteAddr = proxyHeader.SourceAddr
@@ -288,16 +432,30 @@ func (ln *Listener) serveConn(conn net.Conn) error {
 			case proxyproto.PP2_TYPE_ALPN:
 				proto = string(tlv.Value)
 			case proxyproto.PP2_TYPE_SSL:
-				tlsState = parseSSLTLV(tlv)
+				tlsState, clientCert = parseSSLTLV(tlv)
 			}
 		}
 	}
 	conn = proxyConn
 
+	if proto == "" {
+		bufConn, isH2C, err := peekH2C(conn)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		conn = bufConn
+		if isH2C {
+			proto = "h2c"
+		}
+	}
+
 	conn = &Conn{
 		Conn:       conn,
+		ln:         ln,
 		proto:      proto,
 		tlsState:   tlsState,
+		clientCert: clientCert,
 		remoteAddr: remoteAddr,
 	}
 
@@ -306,7 +464,7 @@ func (ln *Listener) serveConn(conn net.Conn) error {
 		defer conn.Close()
 		opts := http2.ServeConnOpts{
 			Context: conn.(*Conn).Context(context.Background()),
-			Handler: ln,
+			Handler: ln.h1Server.Handler,
 		}
 		ln.h2Server.ServeConn(conn, &opts)
 		return nil
@@ -318,6 +476,45 @@ func (ln *Listener) serveConn(conn net.Conn) error {
 	}
 }
 
+// peekH2C checks whether the client starts the connection with the HTTP/2
+// client preface, i.e. uses HTTP/2 with prior knowledge. The returned
+// connection must be used instead of conn.
+func peekH2C(conn net.Conn) (net.Conn, bool, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(httpDefaultReadTimeout)); err != nil {
+		return nil, false, err
+	}
+
+	br := bufio.NewReaderSize(conn, len(http2.ClientPreface))
+	isH2C := true
+	// Peek byte by byte, to avoid blocking on short HTTP/1 requests
+	for i := 1; i <= len(http2.ClientPreface); i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			return nil, false, err
+		}
+		if b[i-1] != http2.ClientPreface[i-1] {
+			isH2C = false
+			break
+		}
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, false, err
+	}
+	return &bufferedConn{conn, br}, isH2C, nil
+}
+
+// bufferedConn is a connection whose beginning has already been read into a
+// buffer.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
+
 func redirectTLS(w http.ResponseWriter, r *http.Request) bool {
 	r.TLS = contextTLSState(r.Context())
 	if r.TLS == nil {
@@ -331,30 +528,51 @@ func (ln *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ln.Mux().ServeHTTP(w, r)
 }
 
-func parseSSLTLV(tlv proxyproto.TLV) *tls.ConnectionState {
+// clientCertState describes the client certificate verification performed by
+// the TLS terminator.
+type clientCertState struct {
+	presented  bool
+	verified   bool
+	commonName string
+}
+
+func parseSSLTLV(tlv proxyproto.TLV) (*tls.ConnectionState, *clientCertState) {
 	ssl, err := tlvparse.SSL(tlv)
 	if err != nil {
 		log.Printf("failed to parse PROXY SSL TLV: %v", err)
-		return nil
+		return nil, nil
 	}
 	if !ssl.ClientSSL() {
-		return nil
+		return nil, nil
 	}
+
+	clientCert := &clientCertState{
+		presented: ssl.ClientCertConn() || ssl.ClientCertSess(),
+	}
+	if clientCert.presented {
+		clientCert.verified = ssl.Verified()
+		clientCert.commonName, _ = ssl.ClientCN()
+	}
+
 	// TODO: parse PP2_SUBTYPE_SSL_VERSION, PP2_SUBTYPE_SSL_CIPHER,
 	// PP2_SUBTYPE_SSL_SIG_ALG, PP2_SUBTYPE_SSL_KEY_ALG
-	return &tls.ConnectionState{}
+	return &tls.ConnectionState{}, clientCert
 }
 
 type Conn struct {
 	net.Conn
+	ln         *Listener
 	proto      string
 	tlsState   *tls.ConnectionState
+	clientCert *clientCertState
 	remoteAddr net.Addr
 }
 
 func (c *Conn) Context(ctx context.Context) context.Context {
 	ctx = context.WithValue(ctx, contextKeyProtocol, c.proto)
 	ctx = context.WithValue(ctx, contextKeyTLSState, c.tlsState)
+	ctx = context.WithValue(ctx, contextKeyClientCert, c.clientCert)
+	ctx = context.WithValue(ctx, contextKeyListener, c.ln)
 	return ctx
 }
 
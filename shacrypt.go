@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt password hashing, as specified in:
+// https://www.akkadia.org/drepper/SHA-crypt.txt
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSaltLen    = 16
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Byte permutations used to encode the final digest
+var (
+	sha256CryptPerm = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptPerm = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+type shaCryptParams struct {
+	newHash      func() hash.Hash
+	perm         [][3]int
+	salt         string
+	rounds       int
+	customRounds bool
+}
+
+// parseSHACrypt parses a "$5$" (SHA-256) or "$6$" (SHA-512) hash.
+func parseSHACrypt(hashed string) (*shaCryptParams, error) {
+	var params shaCryptParams
+	var rest string
+	if s, ok := strings.CutPrefix(hashed, "$5$"); ok {
+		params.newHash, params.perm, rest = sha256.New, sha256CryptPerm, s
+	} else if s, ok := strings.CutPrefix(hashed, "$6$"); ok {
+		params.newHash, params.perm, rest = sha512.New, sha512CryptPerm, s
+	} else {
+		return nil, fmt.Errorf("not a SHA-crypt hash")
+	}
+
+	params.rounds = shaCryptDefaultRounds
+	if s, ok := strings.CutPrefix(rest, "rounds="); ok {
+		roundsStr, after, ok := strings.Cut(s, "$")
+		if !ok {
+			return nil, fmt.Errorf("malformed SHA-crypt hash")
+		}
+		n, err := strconv.Atoi(roundsStr)
+		if err != nil {
+			return nil, fmt.Errorf("malformed SHA-crypt rounds: %v", err)
+		}
+		params.rounds = min(max(n, shaCryptMinRounds), shaCryptMaxRounds)
+		params.customRounds = true
+		rest = after
+	}
+
+	salt, _, ok := strings.Cut(rest, "$")
+	if !ok {
+		return nil, fmt.Errorf("malformed SHA-crypt hash")
+	}
+	if len(salt) > shaCryptMaxSaltLen {
+		salt = salt[:shaCryptMaxSaltLen]
+	}
+	params.salt = salt
+
+	return &params, nil
+}
+
+// checkSHACrypt verifies a password against a SHA-crypt hash.
+func checkSHACrypt(hashed, password string) (bool, error) {
+	params, err := parseSHACrypt(hashed)
+	if err != nil {
+		return false, err
+	}
+	want := shaCrypt(params.newHash, params.perm, []byte(password), []byte(params.salt), params.rounds, params.customRounds)
+	return subtle.ConstantTimeCompare([]byte(want), []byte(hashed)) == 1, nil
+}
+
+func shaCrypt(newHash func() hash.Hash, perm [][3]int, password, salt []byte, rounds int, customRounds bool) string {
+	h := newHash()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+	size := len(b)
+
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(repeatBytes(b, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	p := repeatBytes(h.Sum(nil), len(password))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeatBytes(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i%2 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i%2 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+
+	var sb strings.Builder
+	if size == sha256.Size {
+		sb.WriteString("$5$")
+	} else {
+		sb.WriteString("$6$")
+	}
+	if customRounds {
+		fmt.Fprintf(&sb, "rounds=%d$", rounds)
+	}
+	sb.Write(salt)
+	sb.WriteByte('$')
+	for _, idx := range perm {
+		writeCryptBase64(&sb, uint(c[idx[0]])<<16|uint(c[idx[1]])<<8|uint(c[idx[2]]), 4)
+	}
+	if size == sha256.Size {
+		writeCryptBase64(&sb, uint(c[31])<<8|uint(c[30]), 3)
+	} else {
+		writeCryptBase64(&sb, uint(c[63]), 2)
+	}
+	return sb.String()
+}
+
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
+
+func writeCryptBase64(sb *strings.Builder, v uint, n int) {
+	for i := 0; i < n; i++ {
+		sb.WriteByte(cryptAlphabet[v&0x3f])
+		v >>= 6
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+func init() {
+	// Registered here to avoid an initialization cycle
+	backends["split"] = parseSplit
+}
+
+type splitChoice struct {
+	id      string // stable across weight and order changes, used for sticky cookies
+	weight  int
+	handler http.Handler
+}
+
+// splitBackend sends a share of requests to each of several backends.
+type splitBackend struct {
+	choices     []splitChoice
+	totalWeight int
+
+	stickyCookie string
+	stickyHeader string
+	cookiePath   string
+}
+
+func parseSplit(sc *siteConfig, dir *scfg.Directive) (http.Handler, error) {
+	sb := &splitBackend{
+		cookiePath: strings.TrimSuffix(sc.path, "/") + "/",
+	}
+	occurrences := make(map[string]int)
+	for _, child := range dir.Children {
+		if child.Name == "sticky" {
+			if sb.stickyCookie != "" || sb.stickyHeader != "" {
+				return nil, fmt.Errorf("duplicate directive %q", child.Name)
+			}
+			var kind, name string
+			if err := child.ParseParams(&kind, &name); err != nil {
+				return nil, err
+			}
+			switch kind {
+			case "cookie":
+				sb.stickyCookie = name
+			case "header":
+				sb.stickyHeader = http.CanonicalHeaderKey(name)
+			default:
+				return nil, fmt.Errorf("directive %q: unknown kind %q", child.Name, kind)
+			}
+			continue
+		}
+
+		weight, err := strconv.Atoi(child.Name)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+		if len(child.Params) == 0 {
+			return nil, fmt.Errorf("directive %q: missing backend", child.Name)
+		}
+
+		backendDir := &scfg.Directive{
+			Name:     child.Params[0],
+			Params:   child.Params[1:],
+			Children: child.Children,
+		}
+		f, ok := backends[backendDir.Name]
+		if !ok {
+			return nil, fmt.Errorf("directive %q: unknown backend %q", child.Name, backendDir.Name)
+		}
+
+		var buf strings.Builder
+		scfg.Write(&buf, scfg.Block{backendDir})
+		backendStr := buf.String()
+
+		// Identical backends are distinguished by their occurrence, other
+		// backends can be added or reordered
+		occurrence := occurrences[backendStr]
+		occurrences[backendStr]++
+
+		choiceSC := *sc
+		choiceSC.keyPrefix = fmt.Sprintf("%ssplit %d\n", sc.keyPrefix, occurrence)
+		h, err := f(&choiceSC, backendDir)
+		if err != nil {
+			return nil, fmt.Errorf("directive %q: %v", backendDir.Name, err)
+		}
+
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%d\n%s", occurrence, backendStr)))
+
+		sb.choices = append(sb.choices, splitChoice{
+			id:      hex.EncodeToString(sum[:8]),
+			weight:  weight,
+			handler: h,
+		})
+		sb.totalWeight += weight
+	}
+	if len(sb.choices) == 0 {
+		return nil, fmt.Errorf("missing backend")
+	} else if sb.totalWeight == 0 {
+		return nil, fmt.Errorf("total weight must be positive")
+	}
+	return sb, nil
+}
+
+// pick returns the choice matching a point in [0, totalWeight).
+func (sb *splitBackend) pick(n int) *splitChoice {
+	for i := range sb.choices {
+		c := &sb.choices[i]
+		if n < c.weight {
+			return c
+		}
+		n -= c.weight
+	}
+	panic("unreachable")
+}
+
+func (sb *splitBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var choice *splitChoice
+	switch {
+	case sb.stickyCookie != "":
+		if cookie, err := r.Cookie(sb.stickyCookie); err == nil {
+			for i := range sb.choices {
+				// Backends whose weight has dropped to zero are drained
+				if c := &sb.choices[i]; c.id == cookie.Value && c.weight > 0 {
+					choice = c
+					break
+				}
+			}
+		}
+		if choice == nil {
+			choice = sb.pick(rand.IntN(sb.totalWeight))
+			http.SetCookie(w, &http.Cookie{
+				Name:     sb.stickyCookie,
+				Value:    choice.id,
+				Path:     sb.cookiePath,
+				HttpOnly: true,
+				Secure:   contextTLSState(r.Context()) != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	case sb.stickyHeader != "":
+		addVary(w.Header(), sb.stickyHeader)
+		if v := r.Header.Get(sb.stickyHeader); v != "" {
+			h := fnv.New64a()
+			h.Write([]byte(v))
+			choice = sb.pick(int(h.Sum64() % uint64(sb.totalWeight)))
+		}
+	}
+	if choice == nil {
+		choice = sb.pick(rand.IntN(sb.totalWeight))
+	}
+
+	choice.handler.ServeHTTP(w, r)
+}
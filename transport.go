@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+	"golang.org/x/net/http2"
+)
+
+// transportConfig holds the options of a reverse_proxy transport block.
+type transportConfig struct {
+	tls                   *tls.Config // nil if no TLS option is set
+	dialTimeout           time.Duration
+	keepAlive             time.Duration
+	disableKeepAlives     bool
+	maxIdleConns          int
+	responseHeaderTimeout time.Duration
+}
+
+func parseTransport(dir *scfg.Directive) (*transportConfig, error) {
+	cfg := &transportConfig{}
+	tlsConfig := func() *tls.Config {
+		if cfg.tls == nil {
+			cfg.tls = &tls.Config{}
+		}
+		return cfg.tls
+	}
+
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "tls_ca":
+			if len(child.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one parameter", child.Name)
+			}
+			pool := x509.NewCertPool()
+			for _, filename := range child.Params {
+				b, err := os.ReadFile(filename)
+				if err != nil {
+					return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+				}
+				if !pool.AppendCertsFromPEM(b) {
+					return nil, fmt.Errorf("directive %q: no certificate found in %q", child.Name, filename)
+				}
+			}
+			tlsConfig().RootCAs = pool
+		case "tls_client_cert":
+			var certFilename, keyFilename string
+			if err := child.ParseParams(&certFilename, &keyFilename); err != nil {
+				return nil, err
+			}
+			cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			}
+			tlsConfig().Certificates = []tls.Certificate{cert}
+		case "tls_server_name":
+			if err := child.ParseParams(&tlsConfig().ServerName); err != nil {
+				return nil, err
+			}
+		case "tls_insecure":
+			tlsConfig().InsecureSkipVerify = true
+		case "dial_timeout", "response_header_timeout":
+			var durationStr string
+			if err := child.ParseParams(&durationStr); err != nil {
+				return nil, err
+			}
+			d, err := time.ParseDuration(durationStr)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			} else if d <= 0 {
+				return nil, fmt.Errorf("directive %q: duration must be positive", child.Name)
+			}
+			if child.Name == "dial_timeout" {
+				cfg.dialTimeout = d
+			} else {
+				cfg.responseHeaderTimeout = d
+			}
+		case "keepalive":
+			var s string
+			if err := child.ParseParams(&s); err != nil {
+				return nil, err
+			}
+			if s == "off" {
+				cfg.disableKeepAlives = true
+				break
+			}
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: %v", child.Name, err)
+			} else if d <= 0 {
+				return nil, fmt.Errorf("directive %q: duration must be positive", child.Name)
+			}
+			cfg.keepAlive = d
+		case "max_idle_conns":
+			var s string
+			if err := child.ParseParams(&s); err != nil {
+				return nil, err
+			}
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("directive %q: invalid number %q", child.Name, s)
+			}
+			cfg.maxIdleConns = n
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+
+	return cfg, nil
+}
+
+func (cfg *transportConfig) dialer() *net.Dialer {
+	// Same defaults as http.DefaultTransport
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if cfg.dialTimeout > 0 {
+		dialer.Timeout = cfg.dialTimeout
+	}
+	return dialer
+}
+
+// newHTTPTransport creates a transport for HTTP/1 and HTTP/2 over TLS.
+func (cfg *transportConfig) newHTTPTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = cfg.dialer().DialContext
+	if cfg.tls != nil {
+		t.TLSClientConfig = cfg.tls
+	}
+	// keepalive is about HTTP connection reuse, not TCP keep-alive probes
+	if cfg.keepAlive > 0 {
+		t.IdleConnTimeout = cfg.keepAlive
+	}
+	t.DisableKeepAlives = cfg.disableKeepAlives
+	// The transport only connects to the target server, so the per-host
+	// limit is the limit for the whole pool
+	if cfg.maxIdleConns > 0 {
+		t.MaxIdleConnsPerHost = cfg.maxIdleConns
+	}
+	t.ResponseHeaderTimeout = cfg.responseHeaderTimeout
+	return t
+}
+
+// newH2CTransport creates a transport for HTTP/2 with prior knowledge.
+func (cfg *transportConfig) newH2CTransport() (*http2.Transport, error) {
+	if cfg.tls != nil {
+		return nil, fmt.Errorf("TLS options can't be used with h2c")
+	}
+	if cfg.disableKeepAlives || cfg.maxIdleConns > 0 || cfg.responseHeaderTimeout > 0 {
+		return nil, fmt.Errorf("keepalive off, max_idle_conns and response_header_timeout can't be used with h2c")
+	}
+
+	dialer := cfg.dialer()
+	return &http2.Transport{
+		AllowHTTP:       true,
+		IdleConnTimeout: cfg.keepAlive,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
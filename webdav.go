@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"git.sr.ht/~emersion/go-scfg"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/net/webdav"
+)
+
+// webdavReadMethods lists the methods allowed on read-only WebDAV shares.
+var webdavReadMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+}
+
+// webdavLockSystem allows locks to be carried over when the configuration is
+// reloaded.
+type webdavLockSystem struct {
+	webdav.LockSystem
+}
+
+func init() {
+	// chi rejects unknown methods
+	for _, method := range []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"} {
+		chi.RegisterMethod(method)
+	}
+}
+
+type webdavHandler struct {
+	handler  *webdav.Handler
+	readOnly bool
+}
+
+func parseWebDAV(sc *siteConfig, dir *scfg.Directive) (http.Handler, error) {
+	var dirname string
+	if err := dir.ParseParams(&dirname); err != nil {
+		return nil, err
+	}
+
+	h := &webdavHandler{}
+	hide := defaultHidePatterns
+	symlinks := symlinkRoot
+	for _, child := range dir.Children {
+		switch child.Name {
+		case "read_only":
+			h.readOnly = true
+		case "hide":
+			var err error
+			if hide, err = parseHide(child); err != nil {
+				return nil, err
+			}
+		case "symlinks":
+			var err error
+			if symlinks, err = parseSymlinks(child); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+	}
+
+	if fi, err := os.Stat(dirname); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%q is not a directory", dirname)
+	}
+	fs, err := newRestrictedFileSystem(dirname, hide, symlinks)
+	if err != nil {
+		return nil, err
+	}
+
+	// The site path has been stripped from the request, but WebDAV needs it
+	// to generate hrefs and to resolve Destination header fields
+	prefix := strings.TrimSuffix(sc.path, "/")
+
+	// Locks are keyed by directory, so that they're shared by sites serving
+	// the same directory
+	ls, ok := sc.srv.webdavLocks[fs.root]
+	if !ok {
+		ls = &webdavLockSystem{webdav.NewMemLS()}
+		sc.srv.webdavLocks[fs.root] = ls
+	}
+
+	h.handler = &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: &webdavFileSystem{fs: fs, dir: webdav.Dir(fs.root)},
+		LockSystem: ls,
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("WebDAV %v %v: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	return h, nil
+}
+
+func (h *webdavHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.readOnly && !webdavReadMethods[r.Method] {
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = h.handler.Prefix + "/" + strings.TrimPrefix(r.URL.Path, "/")
+	u.RawPath = ""
+	r2.URL = &u
+	h.handler.ServeHTTP(w, r2)
+}
+
+// webdavFileSystem exposes a restricted directory over WebDAV. Inaccessible
+// files are reported as not existing, and can't be created.
+type webdavFileSystem struct {
+	fs  *restrictedFileSystem
+	dir webdav.Dir
+}
+
+func (wfs *webdavFileSystem) check(op, name string) error {
+	if !wfs.fs.allowed(path.Clean("/" + name)) {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (wfs *webdavFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := wfs.check("mkdir", name); err != nil {
+		return err
+	}
+	return wfs.dir.Mkdir(ctx, name, perm)
+}
+
+func (wfs *webdavFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if err := wfs.check("open", name); err != nil {
+		return nil, err
+	}
+	f, err := wfs.dir.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &webdavFile{File: f, fs: wfs.fs, name: path.Clean("/" + name)}, nil
+}
+
+func (wfs *webdavFileSystem) RemoveAll(ctx context.Context, name string) error {
+	if err := wfs.check("remove", name); err != nil {
+		return err
+	}
+	return wfs.dir.RemoveAll(ctx, name)
+}
+
+func (wfs *webdavFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	if err := wfs.check("rename", oldName); err != nil {
+		return err
+	}
+	if err := wfs.check("rename", newName); err != nil {
+		return err
+	}
+	return wfs.dir.Rename(ctx, oldName, newName)
+}
+
+func (wfs *webdavFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if err := wfs.check("stat", name); err != nil {
+		return nil, err
+	}
+	return wfs.dir.Stat(ctx, name)
+}
+
+// webdavFile omits inaccessible files from directory listings.
+type webdavFile struct {
+	webdav.File
+	fs   *restrictedFileSystem
+	name string
+}
+
+func (f *webdavFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	return f.fs.filterDir(f.name, infos), err
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+const (
+	// websocketCloseTimeout is the time given to clients to complete the
+	// closing handshake when the server shuts down.
+	websocketCloseTimeout = 5 * time.Second
+
+	websocketCloseGoingAway = 1001
+
+	websocketOpClose = 0x8
+	websocketOpPing  = 0x9
+)
+
+var websocketMetrics = newMetrics("websocket", "connections_active", "connections_total", "idle_timeouts")
+
+type websocketConfig struct {
+	pingInterval time.Duration
+	idleTimeout  time.Duration
+}
+
+func parseWebSocket(dir *scfg.Directive) (websocketConfig, error) {
+	var cfg websocketConfig
+	for _, child := range dir.Children {
+		var d *time.Duration
+		switch child.Name {
+		case "ping_interval":
+			d = &cfg.pingInterval
+		case "idle_timeout":
+			d = &cfg.idleTimeout
+		default:
+			return cfg, fmt.Errorf("unknown child directive %q", child.Name)
+		}
+
+		var durationStr string
+		if err := child.ParseParams(&durationStr); err != nil {
+			return cfg, err
+		}
+		var err error
+		if *d, err = time.ParseDuration(durationStr); err != nil {
+			return cfg, fmt.Errorf("directive %q: %v", child.Name, err)
+		} else if *d <= 0 {
+			return cfg, fmt.Errorf("directive %q: duration must be positive", child.Name)
+		}
+	}
+	return cfg, nil
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	for _, v := range r.Header.Values("Connection") {
+		for _, elem := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(elem), "upgrade") {
+				return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+			}
+		}
+	}
+	return false
+}
+
+// websocketRW wraps connections hijacked by httputil.ReverseProxy after a
+// successful WebSocket upgrade.
+type websocketRW struct {
+	http.ResponseWriter
+	ln  *Listener
+	cfg *websocketConfig
+}
+
+var _ http.Hijacker = (*websocketRW)(nil)
+
+func (w *websocketRW) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *websocketRW) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The HTTP server's timeouts don't apply to WebSocket connections
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	wc := newWebSocketConn(conn, w.ln, w.cfg)
+	if !w.ln.addWebSocket(wc) {
+		conn.Close()
+		return nil, nil, net.ErrClosed
+	}
+	websocketMetrics.Add("connections_active", 1)
+	websocketMetrics.Add("connections_total", 1)
+	return wc, brw, nil
+}
+
+// websocketFrameTracker keeps track of frame boundaries in a WebSocket
+// stream, so that control frames can be inserted between frames.
+type websocketFrameTracker struct {
+	header    []byte
+	remaining uint64 // payload bytes left in the current frame
+}
+
+// consume advances the tracker until the end of the current frame or the end
+// of b, and returns the number of bytes consumed.
+func (t *websocketFrameTracker) consume(b []byte) int {
+	n := 0
+	for n < len(b) {
+		if t.remaining > 0 {
+			k := uint64(len(b) - n)
+			if k > t.remaining {
+				k = t.remaining
+			}
+			t.remaining -= k
+			n += int(k)
+			if t.remaining == 0 {
+				return n
+			}
+			continue
+		}
+
+		t.header = append(t.header, b[n])
+		n++
+		if l := websocketHeaderLen(t.header); l > 0 && len(t.header) == l {
+			t.remaining = websocketPayloadLen(t.header)
+			t.header = t.header[:0]
+			if t.remaining == 0 {
+				return n
+			}
+		}
+	}
+	return n
+}
+
+func (t *websocketFrameTracker) boundary() bool {
+	return len(t.header) == 0 && t.remaining == 0
+}
+
+// websocketHeaderLen returns the length of a frame header given its
+// beginning, or 0 if more bytes are needed to find out.
+func websocketHeaderLen(header []byte) int {
+	if len(header) < 2 {
+		return 0
+	}
+	l := 2
+	switch header[1] & 0x7F {
+	case 126:
+		l += 2
+	case 127:
+		l += 8
+	}
+	if header[1]&0x80 != 0 {
+		l += 4 // masking key
+	}
+	return l
+}
+
+func websocketPayloadLen(header []byte) uint64 {
+	switch l := header[1] & 0x7F; l {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(header[2:]))
+	case 127:
+		return binary.BigEndian.Uint64(header[2:])
+	default:
+		return uint64(l)
+	}
+}
+
+func websocketControlFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode, byte(len(payload))}
+	return append(frame, payload...)
+}
+
+func websocketCloseFrame(code uint16, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	return websocketControlFrame(websocketOpClose, append(payload, reason...))
+}
+
+// websocketConn is the client side of a proxied WebSocket connection. It
+// sends pings and closes idle connections, and can send a close frame when
+// the server shuts down.
+type websocketConn struct {
+	net.Conn
+	ln  *Listener
+	cfg *websocketConfig
+
+	lastActivity atomic.Int64 // Unix time in nanoseconds
+	startOnce    sync.Once
+	closeOnce    sync.Once
+	done         chan struct{}
+
+	// Protects writes to the connection
+	mu           sync.Mutex
+	frames       websocketFrameTracker // frames sent by the upstream server
+	started      bool
+	pendingClose []byte
+	closeSent    bool
+}
+
+func newWebSocketConn(conn net.Conn, ln *Listener, cfg *websocketConfig) *websocketConn {
+	wc := &websocketConn{
+		Conn: conn,
+		ln:   ln,
+		cfg:  cfg,
+		done: make(chan struct{}),
+	}
+	wc.touch()
+	return wc
+}
+
+func (wc *websocketConn) touch() {
+	wc.lastActivity.Store(time.Now().UnixNano())
+}
+
+// start is called when the connection is used for the first time. Before
+// that, httputil.ReverseProxy may still be writing the upgrade response.
+func (wc *websocketConn) start() {
+	wc.startOnce.Do(func() {
+		wc.mu.Lock()
+		wc.started = true
+		wc.mu.Unlock()
+
+		if wc.cfg.pingInterval > 0 || wc.cfg.idleTimeout > 0 {
+			go wc.monitor()
+		}
+	})
+}
+
+func (wc *websocketConn) Read(b []byte) (int, error) {
+	wc.start()
+	n, err := wc.Conn.Read(b)
+	if n > 0 {
+		wc.touch()
+	}
+	return n, err
+}
+
+func (wc *websocketConn) Write(b []byte) (int, error) {
+	wc.start()
+	wc.touch()
+
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		if err := wc.flushPendingClose(); err != nil {
+			return written, err
+		}
+		if wc.closeSent {
+			// Frames can't be sent after a close frame, discard them
+			return written + len(b), nil
+		}
+
+		n := wc.frames.consume(b)
+		n, err := wc.Conn.Write(b[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, wc.flushPendingClose()
+}
+
+func (wc *websocketConn) flushPendingClose() error {
+	if wc.pendingClose == nil || !wc.started || !wc.frames.boundary() {
+		return nil
+	}
+	frame := wc.pendingClose
+	wc.pendingClose = nil
+	wc.closeSent = true
+	_, err := wc.Conn.Write(frame)
+	return err
+}
+
+// writeControl sends a control frame, if the connection is between two
+// frames. It returns false otherwise.
+func (wc *websocketConn) writeControl(frame []byte) bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	if !wc.started || wc.closeSent || !wc.frames.boundary() {
+		return false
+	}
+	wc.Conn.Write(frame)
+	return true
+}
+
+// sendClose sends a close frame as soon as the current frame has been fully
+// sent.
+func (wc *websocketConn) sendClose(code uint16, reason string) {
+	// Unblock writes stuck on an unresponsive client
+	wc.Conn.SetWriteDeadline(time.Now().Add(websocketCloseTimeout))
+
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	if wc.closeSent || wc.pendingClose != nil {
+		return
+	}
+	wc.pendingClose = websocketCloseFrame(code, reason)
+	wc.flushPendingClose()
+}
+
+func (wc *websocketConn) monitor() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var lastPing time.Time
+	for {
+		select {
+		case <-timer.C:
+		case <-wc.done:
+			return
+		}
+
+		now := time.Now()
+		lastActivity := time.Unix(0, wc.lastActivity.Load())
+		var next time.Time
+
+		if wc.cfg.idleTimeout > 0 {
+			deadline := lastActivity.Add(wc.cfg.idleTimeout)
+			if !now.Before(deadline) {
+				websocketMetrics.Add("idle_timeouts", 1)
+				wc.sendClose(websocketCloseGoingAway, "idle timeout")
+				wc.Close()
+				return
+			}
+			next = deadline
+		}
+
+		if wc.cfg.pingInterval > 0 {
+			t := lastActivity
+			if lastPing.After(t) {
+				t = lastPing
+			}
+			pingAt := t.Add(wc.cfg.pingInterval)
+			if !now.Before(pingAt) {
+				if wc.writeControl(websocketControlFrame(websocketOpPing, nil)) {
+					lastPing = now
+					pingAt = now.Add(wc.cfg.pingInterval)
+				} else {
+					// In the middle of a frame, which counts as activity
+					pingAt = now.Add(time.Second)
+				}
+			}
+			if next.IsZero() || pingAt.Before(next) {
+				next = pingAt
+			}
+		}
+
+		timer.Reset(time.Until(next))
+	}
+}
+
+// shutdown gracefully closes the connection: a close frame is sent, and the
+// connection is closed once the closing handshake is complete or after a
+// timeout.
+func (wc *websocketConn) shutdown() {
+	wc.sendClose(websocketCloseGoingAway, "server shutting down")
+
+	select {
+	case <-wc.done:
+	case <-time.After(websocketCloseTimeout):
+		wc.Close()
+	}
+}
+
+func (wc *websocketConn) Close() error {
+	err := wc.Conn.Close()
+	wc.closeOnce.Do(func() {
+		close(wc.done)
+		websocketMetrics.Add("connections_active", -1)
+		wc.ln.removeWebSocket(wc)
+	})
+	return err
+}